@@ -3,7 +3,6 @@ package client
 import (
 	"context"
 	"crypto/tls"
-	"errors"
 	"fmt"
 	"github.com/genshen/wssocks/wss"
 	"github.com/genshen/wssocks/wss/term_view"
@@ -42,20 +41,40 @@ func NewHttpClient() (*http.Client, *http.Transport) {
 }
 
 type Options struct {
-	LocalSocks5Addr string      // local listening address
-	HttpEnabled     bool        // enable http and https proxy
-	LocalHttpAddr   string      // listen address of http and https(if it is enabled)
-	RemoteUrl       *url.URL    // url of server
-	RemoteHeaders   http.Header // parsed websocket headers (not presented in flag).
-	ConnectionKey   string      // connection key for authentication
-	SkipTLSVerify   bool        // skip TSL verify
+	LocalSocks5Addr   string           // local listening address
+	HttpEnabled       bool             // enable http and https proxy
+	LocalHttpAddr     string           // listen address of http (if it is enabled), empty for serving http on LocalSocks5Addr only
+	RemoteUrl         *url.URL         // url of server
+	RemoteHeaders     http.Header      // parsed websocket headers (not presented in flag).
+	ConnectionKey     string           // connection key for authentication
+	SkipTLSVerify     bool             // skip TSL verify
+	Reconnect         ReconnectOptions // reconnecting options if websocket connection is lost
+	Connections       int              // count of websocket connections to server, proxy connections are spread across them
+	PoolStrategy      PoolStrategy     // strategy to pick a websocket connection for a new proxy connection
+	Compression       bool             // ask server for compressing data frames
+	CompressThreshold int              // min size of data to be compressed, 0 for wss.DefaultCompressThreshold
+	// username and password pairs accepted by socks5 authentication, empty for no authentication.
+	Socks5Credentials wss.Credentials
+	// username and password pairs accepted by http(s) proxy Basic authentication, empty for no authentication.
+	HttpCredentials wss.Credentials
+	// add Via and X-Forwarded-For headers to the requests forwarded by http proxy.
+	HttpVia          bool
+	HttpForwardedFor bool
+	// proxy auto-config script served on http listener (at wss.PacPath), nil for disabling it.
+	Pac *wss.Pac
+	// listen address of transparent proxy (linux only), empty for disabling it.
+	TransparentAddr string
+	// static port forwardings to fixed targets via server.
+	Forwards []Forward
 }
 
 type Handles struct {
 	wsc        *wss.WebSocketClient
-	hb         *wss.HeartBeat
-	httpServer *http.Server
+	pool       *connPool // websocket connections to server, each one is kept alive
+	httpListen net.Listener
 	cl         *wss.Client
+	tproxy     *wss.Client // transparent proxy, nil if it is disabled
+	forwards   []*wss.Client
 	closed     bool
 	eg         *errgroup.Group
 }
@@ -77,13 +96,18 @@ func (hdl *Handles) NotifyClose(once *sync.Once, wait bool) {
 		if hdl.cl != nil {
 			hdl.cl.Close(wait)
 		}
-		if hdl.httpServer != nil {
-			hdl.httpServer.Shutdown(context.TODO())
+		if hdl.tproxy != nil {
+			hdl.tproxy.Close(wait)
 		}
-		if hdl.hb != nil {
-			hdl.hb.Close()
+		for _, f := range hdl.forwards {
+			f.Close(wait)
 		}
-		if hdl.wsc != nil {
+		if hdl.httpListen != nil {
+			hdl.httpListen.Close()
+		}
+		if hdl.pool != nil {
+			hdl.pool.close()
+		} else if hdl.wsc != nil {
 			hdl.wsc.Close()
 		}
 	})
@@ -91,9 +115,30 @@ func (hdl *Handles) NotifyClose(once *sync.Once, wait bool) {
 
 // CreateServerConn create a server websocket connection based on user options.
 func (hdl *Handles) CreateServerConn(c *Options, ctx context.Context) (*wss.WebSocketClient, error) {
+	// options are shared by the connections in the pool (dialed concurrently), so they are only modified here.
+	if c.RemoteHeaders == nil {
+		c.RemoteHeaders = make(http.Header)
+	}
 	if c.ConnectionKey != "" {
 		c.RemoteHeaders.Set("Key", c.ConnectionKey)
 	}
+	wsc, err := hdl.dialServer(c, ctx)
+	if err != nil {
+		return nil, err
+	}
+	// todo chan for wsc and tcp accept
+	hdl.wsc = wsc
+	return wsc, nil
+}
+
+// create a websocket connection to server, it is used by CreateServerConn and connections in the pool.
+// c is not modified, the url and headers passed to the request plugin are copies for this connection.
+func (hdl *Handles) dialServer(c *Options, ctx context.Context) (*wss.WebSocketClient, error) {
+	remoteUrl := *c.RemoteUrl
+	remoteHeaders := c.RemoteHeaders.Clone()
+	if remoteHeaders == nil {
+		remoteHeaders = make(http.Header)
+	}
 
 	httpClient, transport := NewHttpClient()
 
@@ -115,24 +160,30 @@ func (hdl *Handles) CreateServerConn(c *Options, ctx context.Context) (*wss.WebS
 	// loading and execute plugin
 	if clientPlugin.HasRequestPlugin() {
 		// in the plugin, we may add http header/dialer and modify remote address.
-		if err := clientPlugin.RequestPlugin.BeforeRequest(httpClient, transport, c.RemoteUrl, &c.RemoteHeaders); err != nil {
+		if err := clientPlugin.RequestPlugin.BeforeRequest(httpClient, transport, &remoteUrl, &remoteHeaders); err != nil {
 			return nil, err
 		}
 	}
 
 	// start websocket connection (to remote server).
-	wsc, err := wss.NewWebSocketClient(ctx, c.RemoteUrl.String(), httpClient, c.RemoteHeaders)
+	wsc, err := wss.NewWebSocketClient(ctx, remoteUrl.String(), httpClient, remoteHeaders)
 	if err != nil {
 		return nil, fmt.Errorf("establishing connection error: %w", err)
 	}
-	// todo chan for wsc and tcp accept
-	hdl.wsc = wsc
+	if c.Compression {
+		wsc.SetCompression(wss.CompressionFlate, c.CompressThreshold) // to be negotiated with server
+	}
 	return wsc, nil
 }
 
 func (hdl *Handles) NegotiateVersion(ctx context.Context, remoteUrl string) error {
+	return hdl.negotiateVersion(ctx, hdl.wsc, remoteUrl)
+}
+
+// negotiate version with server on websocket connection wsc.
+func (hdl *Handles) negotiateVersion(ctx context.Context, wsc *wss.WebSocketClient, remoteUrl string) error {
 	// negotiate version
-	if version, err := wss.ExchangeVersion(ctx, hdl.wsc.WsConn); err != nil {
+	if version, err := wss.ExchangeVersion(ctx, &wsc.ConcurrentWebSocket); err != nil {
 		return err
 	} else {
 		if clientPlugin.HasVersionPlugin() {
@@ -144,12 +195,13 @@ func (hdl *Handles) NegotiateVersion(ctx context.Context, remoteUrl string) erro
 				"compatible version code": version.CompVersion,
 				"version code":            version.VersionCode,
 				"version number":          version.Version,
+				"features":                wsc.Features(),
 			}).Info("server version")
 
-			// client protocol version must eq or smaller than server version (newer client is not allowed)
-			// And, compatible version is the lowest version for client.
-			if version.CompVersion > wss.VersionCode || wss.VersionCode > version.VersionCode {
-				return errors.New("incompatible protocol version of client and server")
+			// server's compatible version is the lowest version for client,
+			// and client's compatible version is the lowest version for server.
+			if !wss.IsCompatible(version) {
+				return wss.ErrIncompatibleVersion
 			}
 			if version.Version != wss.CoreVersion {
 				log.WithFields(log.Fields{
@@ -178,37 +230,46 @@ func (hdl *Handles) StartClient(c *Options, once *sync.Once) {
 		if hdl.cl != nil {
 			hdl.cl.Close(false)
 		}
-		if hdl.httpServer != nil {
-			hdl.httpServer.Shutdown(context.TODO())
+		if hdl.tproxy != nil {
+			hdl.tproxy.Close(false)
 		}
-		if hdl.hb != nil {
-			hdl.hb.Close()
+		for _, f := range hdl.forwards {
+			f.Close(false)
 		}
-		if hdl.wsc != nil {
-			hdl.wsc.Close()
+		if hdl.httpListen != nil {
+			hdl.httpListen.Close()
 		}
+		hdl.pool.close()
 	}
 
-	// start websocket message listen.
-	hdl.eg.Go(func() error {
-		defer once.Do(closeAll)
-		if err := hdl.wsc.ListenIncomeMsg(1 << 29); err != nil {
-			return fmt.Errorf("error websocket read %w", err)
-		}
-		return nil
-	})
-	// send heart beats.
-	heartbeat, hbCtx := wss.NewHeartBeat(hdl.wsc)
-	hdl.hb = heartbeat
-	hdl.eg.Go(func() error {
-		defer once.Do(closeAll)
-		if err := hdl.hb.Start(hbCtx, time.Minute); err != nil {
-			return fmt.Errorf("heartbeat ending %w", err)
-		}
-		return nil
-	})
+	httpEnabled := c.HttpEnabled
+	if httpEnabled && hdl.wsc.Features() != nil && !hdl.wsc.HasFeature(wss.FeatureHttpProxy) {
+		log.Warning("http(s) proxy is disabled by server, it is not started at client side.")
+		httpEnabled = false
+	}
+
+	// start websocket message listen and heart beats sending,
+	// and reconnect to server if the connection is lost.
+	// The first connection is already established, and the others in the pool are established in background.
+	members := make([]*connSupervisor, 0, c.Connections)
+	members = append(members, newConnSupervisor(hdl, c, hdl.wsc))
+	for i := 1; i < c.Connections; i++ {
+		members = append(members, newConnSupervisor(hdl, c, nil))
+	}
+	hdl.pool = newConnPool(c.PoolStrategy, members)
+	notifyConnState(StateConnected, nil)
+	for _, member := range members {
+		member := member
+		hdl.eg.Go(func() error {
+			defer once.Do(closeAll)
+			return member.run()
+		})
+	}
 
 	record := wss.NewConnRecord()
+	if c.Connections > 1 {
+		record.Streams = hdl.pool.ConnSizes
+	}
 	if terminal.IsTerminal(int(os.Stdout.Fd())) {
 		// if it is tty, use term_view as output, and set onChange function to update output
 		plog := term_view.NewPLog(record)
@@ -229,29 +290,82 @@ func (hdl *Handles) StartClient(c *Options, once *sync.Once) {
 		}
 	}
 
+	// http proxy, served on http listen address (if it is not empty) and socks5 listen address.
+	handle := wss.NewHttpProxy(hdl.pool, record)
+	handle.SetCredentials(c.HttpCredentials)
+	handle.SetForwardHeaders(c.HttpVia, c.HttpForwardedFor)
+
 	// http listening
-	if c.HttpEnabled {
+	if httpEnabled && c.LocalHttpAddr != "" {
 		log.WithField("http listen address", c.LocalHttpAddr).
 			Info("listening on local address for incoming proxy requests.")
+		if c.Pac != nil {
+			handle.SetPac(c.Pac)
+			log.WithField("path", wss.PacPath).Info("proxy auto-config is served on http listen address.")
+		}
 		hdl.eg.Go(func() error {
 			defer once.Do(closeAll)
-			handle := wss.NewHttpProxy(hdl.wsc, record)
-			hdl.httpServer = &http.Server{Addr: c.LocalHttpAddr, Handler: &handle}
-			if err := hdl.httpServer.ListenAndServe(); err != nil {
+			l, err := net.Listen("tcp", c.LocalHttpAddr)
+			if err != nil {
 				return err
 			}
+			hdl.httpListen = l
+			return handle.Serve(l)
+		})
+	}
+
+	// transparent proxy listening
+	if c.TransparentAddr != "" {
+		hdl.tproxy = wss.NewClient()
+		hdl.eg.Go(func() error {
+			defer once.Do(closeAll)
+			if err := hdl.tproxy.ListenAndServeTransparent(record, hdl.pool, c.TransparentAddr, func() {
+				log.WithField("transparent listen address", c.TransparentAddr).
+					Info("listening on local address for redirected connections.")
+			}); err != nil {
+				return fmt.Errorf("start transparent proxy error %w", err)
+			}
+			return nil
+		})
+	}
+
+	// static port forwarding
+	for _, forward := range c.Forwards {
+		forward := forward
+		fc := wss.NewClient()
+		hdl.forwards = append(hdl.forwards, fc)
+		hdl.eg.Go(func() error {
+			defer once.Do(closeAll)
+			listen := fc.ListenAndServeForward
+			if forward.Network == "udp" {
+				listen = fc.ListenAndServeUdpForward
+			}
+			if err := listen(record, hdl.pool, forward.LocalAddr, forward.Target, func() {
+				log.WithField("forward", forward.String()).Info("listening on local address for port forwarding.")
+			}); err != nil {
+				return fmt.Errorf("start port forwarding %s error %w", forward, err)
+			}
 			return nil
 		})
 	}
 
 	// start listen for socks5 and https connection.
 	hdl.cl = wss.NewClient()
+	hdl.cl.SetHttpProxy(&handle)
+	if len(c.Socks5Credentials) > 0 {
+		hdl.cl.SetSocks5Credentials(c.Socks5Credentials)
+		log.WithField("users", len(c.Socks5Credentials)).Info("socks5 username/password authentication is enabled.")
+	}
+	if httpEnabled && len(c.HttpCredentials) > 0 {
+		hdl.cl.SetHttpCredentials(c.HttpCredentials)
+		log.WithField("users", len(c.HttpCredentials)).Info("http(s) proxy authentication is enabled.")
+	}
 	hdl.eg.Go(func() error {
 		defer once.Do(closeAll)
-		if err := hdl.cl.ListenAndServe(record, hdl.wsc, c.LocalSocks5Addr, c.HttpEnabled, func() {
-			if c.HttpEnabled {
+		if err := hdl.cl.ListenAndServe(record, hdl.pool, c.LocalSocks5Addr, httpEnabled, func() {
+			if httpEnabled {
 				log.WithField("socks5 listen address", c.LocalSocks5Addr).
-					WithField("https listen address", c.LocalSocks5Addr).
+					WithField("http(s) listen address", c.LocalSocks5Addr).
 					Info("listening on local address for incoming proxy requests.")
 			} else {
 				log.WithField("socks5 listen address", c.LocalSocks5Addr).
@@ -266,6 +380,21 @@ func (hdl *Handles) StartClient(c *Options, once *sync.Once) {
 	hdl.closed = false
 }
 
+// ConnSizes returns the count of proxy connections on each websocket connection to server.
+func (hdl *Handles) ConnSizes() []int {
+	if hdl.pool == nil {
+		return nil
+	}
+	return hdl.pool.ConnSizes()
+}
+
+// CompressionStats returns the statistics of data compression on the current websocket connections to server.
+func (hdl *Handles) CompressionStats() wss.CompressionStats {
+	if hdl.pool == nil {
+		return wss.CompressionStats{}
+	}
+	return hdl.pool.compressionStats()
+}
 
 // Wait waits an error in client connection.
 // If the connection lost or any other connection error happens, Wait will return an error.
@@ -22,11 +22,18 @@ type VersionPlugin interface {
 	OnServerVersion(ver wss.VersionNeg) error
 }
 
+// observe the state changes of websocket connection to server (e.g. disconnected, reconnecting).
+// err is the reason of disconnection or closing, it can be nil.
+type ConnStatePlugin interface {
+	OnConnStateChange(state ConnState, err error)
+}
+
 // Plugins is a collection of all possible plugins on client
 type Plugins struct {
-	OptionPlugin  OptionPlugin
-	RequestPlugin RequestPlugin
-	VersionPlugin VersionPlugin
+	OptionPlugin    OptionPlugin
+	RequestPlugin   RequestPlugin
+	VersionPlugin   VersionPlugin
+	ConnStatePlugin ConnStatePlugin
 }
 
 var ErrPluginOccupied = errors.New("the plugin is occupied by another plugin")
@@ -47,6 +54,10 @@ func (plugin *Plugins) HasVersionPlugin() bool {
 	return plugin.VersionPlugin != nil
 }
 
+func (plugin *Plugins) HasConnStatePlugin() bool {
+	return plugin.ConnStatePlugin != nil
+}
+
 var clientPlugin Plugins
 
 // add an option plugin
@@ -75,3 +86,19 @@ func AddPluginVersion(verPlugin VersionPlugin) error {
 	clientPlugin.VersionPlugin = verPlugin
 	return nil
 }
+
+// add a connection state plugin
+func AddPluginConnState(statePlugin ConnStatePlugin) error {
+	if clientPlugin.ConnStatePlugin != nil {
+		return ErrPluginOccupied
+	}
+	clientPlugin.ConnStatePlugin = statePlugin
+	return nil
+}
+
+// call connection state plugin if it is added.
+func notifyConnState(state ConnState, err error) {
+	if clientPlugin.HasConnStatePlugin() {
+		clientPlugin.ConnStatePlugin.OnConnStateChange(state, err)
+	}
+}
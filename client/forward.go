@@ -0,0 +1,44 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Forward is a static port forwarding: connections (or datagrams) on LocalAddr are forwarded to Target via server.
+type Forward struct {
+	Network   string // "tcp" or "udp"
+	LocalAddr string // local listen address
+	Target    string // host:port of the target, connected by server
+}
+
+func (f Forward) String() string {
+	return f.LocalAddr + "=" + f.Target + "/" + f.Network
+}
+
+// ParseForward parses a port forwarding in format "local_addr=remote_host:port[/udp]" (tcp by default).
+// If local_addr is only a port, it listens on 127.0.0.1.
+func ParseForward(spec string) (Forward, error) {
+	f := Forward{Network: "tcp"}
+	rest := spec
+	if i := strings.LastIndexByte(rest, '/'); i != -1 {
+		f.Network = rest[i+1:]
+		rest = rest[:i]
+	}
+	i := strings.IndexByte(rest, '=')
+	if i == -1 || (f.Network != "tcp" && f.Network != "udp") {
+		return f, fmt.Errorf("bad port forwarding %q, it should be local_addr=remote_host:port[/udp]", spec)
+	}
+	f.LocalAddr, f.Target = rest[:i], rest[i+1:]
+	if !strings.Contains(f.LocalAddr, ":") {
+		f.LocalAddr = net.JoinHostPort("127.0.0.1", f.LocalAddr)
+	}
+	if _, _, err := net.SplitHostPort(f.LocalAddr); err != nil {
+		return f, fmt.Errorf("bad local address of port forwarding %q: %w", spec, err)
+	}
+	if host, port, err := net.SplitHostPort(f.Target); err != nil || host == "" || port == "" {
+		return f, fmt.Errorf("bad target of port forwarding %q", spec)
+	}
+	return f, nil
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/genshen/wssocks/wss"
+)
+
+// PoolStrategy decides which websocket connection in the pool is used for a new proxy connection.
+type PoolStrategy int
+
+const (
+	PoolLeastLoaded PoolStrategy = iota // pick the connection with the fewest proxy connections.
+	PoolRoundRobin                      // pick the connections in turn.
+)
+
+func (p PoolStrategy) String() string {
+	switch p {
+	case PoolLeastLoaded:
+		return "least-loaded"
+	case PoolRoundRobin:
+		return "round-robin"
+	}
+	return "unknown"
+}
+
+// ParsePoolStrategy parses the name of a pool strategy ("least-loaded" or "round-robin").
+func ParsePoolStrategy(name string) (PoolStrategy, error) {
+	switch name {
+	case "least-loaded":
+		return PoolLeastLoaded, nil
+	case "round-robin":
+		return PoolRoundRobin, nil
+	}
+	return PoolLeastLoaded, fmt.Errorf("unknown pool strategy: %s", name)
+}
+
+// connPool holds several websocket connections to the same server,
+// each connection is kept alive by its own supervisor.
+// It implements wss.WebSocketClientPicker, new proxy connections are spread across the connections.
+type connPool struct {
+	strategy PoolStrategy
+	members  []*connSupervisor
+	next     uint32 // counter for round-robin
+}
+
+func newConnPool(strategy PoolStrategy, members []*connSupervisor) *connPool {
+	return &connPool{strategy: strategy, members: members}
+}
+
+// Pick picks a connected websocket connection by the strategy of pool.
+// If no connection is available now, it waits for one of them to be (re)connected.
+func (p *connPool) Pick() (*wss.WebSocketClient, error) {
+	if len(p.members) == 1 {
+		return p.members[0].Pick()
+	}
+	start := int(atomic.AddUint32(&p.next, 1) - 1)
+	var picked *connSupervisor = nil
+	least := 0
+	for i := range p.members {
+		member := p.members[(start+i)%len(p.members)]
+		if !member.connected() {
+			continue
+		}
+		if p.strategy == PoolRoundRobin {
+			picked = member
+			break
+		}
+		if size := member.streams(); picked == nil || size < least {
+			picked, least = member, size
+		}
+	}
+	if picked == nil {
+		// all connections are (re)connecting.
+		picked = p.members[start%len(p.members)]
+	}
+	return picked.Pick()
+}
+
+// ConnSizes returns the count of proxy connections on each websocket connection.
+func (p *connPool) ConnSizes() []int {
+	sizes := make([]int, len(p.members))
+	for i, member := range p.members {
+		sizes[i] = member.streams()
+	}
+	return sizes
+}
+
+func (p *connPool) compressionStats() wss.CompressionStats {
+	var stats wss.CompressionStats
+	for _, member := range p.members {
+		stats = stats.Add(member.compressionStats())
+	}
+	return stats
+}
+
+func (p *connPool) close() {
+	for _, member := range p.members {
+		member.close()
+	}
+}
@@ -0,0 +1,376 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/genshen/wssocks/wss"
+	log "github.com/sirupsen/logrus"
+	"nhooyr.io/websocket"
+)
+
+// ConnState is the state of websocket connection between client and server.
+type ConnState int
+
+const (
+	StateConnected    ConnState = iota // websocket connection is established and version is negotiated.
+	StateDisconnected                  // websocket connection is lost.
+	StateReconnecting                  // trying to reconnect to server.
+	StateClosed                        // client is closed, or it gives up reconnecting.
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+var ErrClientClosed = errors.New("client is closed")
+
+// waiting time for a new proxy connection, if the websocket is reconnecting.
+const pickTimeout = time.Minute
+
+// ReconnectOptions controls reconnecting after websocket connection is lost.
+// The delay before n-th retry is InitialDelay * Multiplier^(n-1), but no more than MaxDelay,
+// and then a random jitter in [-Jitter*delay, Jitter*delay] is applied.
+type ReconnectOptions struct {
+	Enable       bool          // enable reconnecting
+	InitialDelay time.Duration // delay before the first retry
+	MaxDelay     time.Duration // max delay between two retries
+	Multiplier   float64       // growth factor of the delay
+	Jitter       float64       // randomization factor of delay, in range [0, 1]
+	MaxRetries   int           // max retries for one disconnection, 0 for unlimited
+}
+
+func DefaultReconnectOptions() ReconnectOptions {
+	return ReconnectOptions{
+		Enable:       true,
+		InitialDelay: time.Second,
+		MaxDelay:     time.Minute,
+		Multiplier:   2,
+		Jitter:       0.2,
+		MaxRetries:   0,
+	}
+}
+
+// return the delay before the attempt-th retry (attempt starts from 1).
+func (opt *ReconnectOptions) backoff(attempt int) time.Duration {
+	delay := float64(opt.InitialDelay)
+	for i := 1; i < attempt && delay < float64(opt.MaxDelay); i++ {
+		delay *= opt.Multiplier
+	}
+	if delay > float64(opt.MaxDelay) {
+		delay = float64(opt.MaxDelay)
+	}
+	if opt.Jitter > 0 {
+		delay += delay * opt.Jitter * (2*rand.Float64() - 1)
+	}
+	if delay < 0 {
+		return 0
+	}
+	return time.Duration(delay)
+}
+
+// connSupervisor keeps the websocket connection to server alive.
+// If the connection is lost, it redials and negotiates version again with backoff,
+// while the local listeners keep working.
+// It implements wss.WebSocketClientPicker, the current connection is picked for new proxy connections.
+type connSupervisor struct {
+	hdl     *Handles
+	options *Options
+
+	mu     sync.Mutex
+	wsc    *wss.WebSocketClient
+	hb     *wss.HeartBeat
+	ready  chan struct{} // closed if the connection is available
+	closed bool
+	stop   chan struct{}
+}
+
+// create a supervisor for websocket connection wsc.
+// If wsc is nil, the connection is established when the supervisor runs.
+func newConnSupervisor(hdl *Handles, options *Options, wsc *wss.WebSocketClient) *connSupervisor {
+	s := connSupervisor{hdl: hdl, options: options, wsc: wsc, ready: make(chan struct{}), stop: make(chan struct{})}
+	if wsc != nil {
+		close(s.ready) // the first connection is already established
+	}
+	return &s
+}
+
+// Pick returns the current websocket connection.
+// If it is reconnecting, wait until the connection is available again.
+func (s *connSupervisor) Pick() (*wss.WebSocketClient, error) {
+	s.mu.Lock()
+	ready := s.ready
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+	case <-s.stop:
+		return nil, ErrClientClosed
+	case <-time.After(pickTimeout):
+		return nil, errors.New("timeout for waiting connection to server")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrClientClosed
+	}
+	return s.wsc, nil
+}
+
+// connected returns true if the websocket connection is available now.
+func (s *connSupervisor) connected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.ready:
+		return !s.closed
+	default:
+		return false
+	}
+}
+
+// streams returns the count of proxy connections on the current websocket connection.
+func (s *connSupervisor) streams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wsc == nil {
+		return 0
+	}
+	return s.wsc.ConnSize()
+}
+
+func (s *connSupervisor) compressionStats() wss.CompressionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wsc == nil {
+		return wss.CompressionStats{}
+	}
+	return s.wsc.CompressionStats()
+}
+
+// run listens incoming messages and sends heartbeats on the current websocket connection.
+// If the connection is lost, it reconnects to server if reconnecting is enabled.
+// It returns when the supervisor is closed or reconnecting fails.
+func (s *connSupervisor) run() error {
+	s.mu.Lock()
+	initial := s.wsc
+	s.mu.Unlock()
+	if initial == nil {
+		if err := s.connect(); err != nil {
+			if s.isClosed() {
+				notifyConnState(StateClosed, nil)
+				return nil
+			}
+			notifyConnState(StateClosed, err)
+			return err
+		}
+	}
+
+	for {
+		s.mu.Lock()
+		wsc := s.wsc
+		s.mu.Unlock()
+		err := s.serve(wsc)
+
+		if s.isClosed() {
+			notifyConnState(StateClosed, nil)
+			return nil
+		}
+		notifyConnState(StateDisconnected, err)
+		if !s.options.Reconnect.Enable {
+			notifyConnState(StateClosed, err)
+			return fmt.Errorf("error websocket read %w", err)
+		}
+		if err := s.reconnect(); err != nil {
+			if s.isClosed() {
+				notifyConnState(StateClosed, nil)
+				return nil
+			}
+			notifyConnState(StateClosed, err)
+			return err
+		}
+	}
+}
+
+// serve websocket messages and heartbeats until the connection is lost.
+func (s *connSupervisor) serve(wsc *wss.WebSocketClient) error {
+	heartbeat, hbCtx := wss.NewHeartBeat(wsc)
+	s.mu.Lock()
+	s.hb = heartbeat
+	s.mu.Unlock()
+
+	conn := wsc.Conn() // the connection may be replaced after resuming, only close the one served here.
+	go func() {
+		if err := heartbeat.Start(hbCtx, time.Minute); err != nil {
+			log.WithField("error", err).Warning("heartbeat ending, close the connection")
+			_ = conn.Close(websocket.StatusNormalClosure, "") // the listening below will return
+		}
+	}()
+	defer heartbeat.Close()
+	return wsc.ListenIncomeMsg(1 << 29)
+}
+
+// establish the connection for a supervisor created without connection.
+// If it fails, retry with backoff if reconnecting is enabled.
+func (s *connSupervisor) connect() error {
+	wsc, err := s.dial()
+	if err == nil {
+		s.onConnected(wsc)
+		log.WithField("remote", s.options.RemoteUrl.String()).Info("connected to wssocks server.")
+		return nil
+	}
+	if !s.options.Reconnect.Enable {
+		return err
+	}
+	log.WithField("error", err).Warning("connect failed.")
+	return s.reconnect()
+}
+
+// redial and negotiate version with backoff, until success or retries exhausted.
+// If server resumes the session, the proxy connections on the lost connection are kept,
+// otherwise they are closed.
+func (s *connSupervisor) reconnect() error {
+	s.mu.Lock()
+	select {
+	case <-s.ready:
+		s.ready = make(chan struct{}) // new proxy connections wait for reconnecting.
+	default: // not connected yet
+	}
+	s.mu.Unlock()
+
+	opt := s.options.Reconnect
+	for attempt := 1; opt.MaxRetries == 0 || attempt <= opt.MaxRetries; attempt++ {
+		delay := opt.backoff(attempt)
+		notifyConnState(StateReconnecting, nil)
+		log.WithFields(log.Fields{
+			"attempt": attempt,
+			"delay":   delay.String(),
+		}).Info("reconnecting to wssocks server.")
+
+		select {
+		case <-s.stop:
+			return ErrClientClosed
+		case <-time.After(delay):
+		}
+
+		wsc, err := s.dial()
+		if err != nil {
+			log.WithField("error", err).Warning("reconnect failed.")
+			continue
+		}
+		if wsc, err = s.resume(wsc); err != nil {
+			log.WithField("error", err).Warning("reconnect failed.")
+			continue
+		}
+
+		if !s.onConnected(wsc) {
+			return ErrClientClosed
+		}
+		log.WithField("remote", s.options.RemoteUrl.String()).Info("reconnected to wssocks server.")
+		return nil
+	}
+	s.mu.Lock()
+	prev := s.wsc
+	s.mu.Unlock()
+	if prev != nil {
+		prev.CloseAllProxies()
+	}
+	return fmt.Errorf("give up reconnecting after %d retries", opt.MaxRetries)
+}
+
+// move the proxies on the lost connection to the new connection wsc if the session is resumed,
+// and return the connection to be used.
+func (s *connSupervisor) resume(wsc *wss.WebSocketClient) (*wss.WebSocketClient, error) {
+	s.mu.Lock()
+	prev := s.wsc
+	s.mu.Unlock()
+
+	if prev == nil {
+		return wsc, nil
+	}
+	if !wsc.Resumed() {
+		prev.CloseAllProxies()
+		return wsc, nil
+	}
+	if err := prev.Reattach(wsc); err != nil {
+		_ = wsc.Close()
+		return nil, err
+	}
+	log.Info("session resumed.")
+	return prev, nil
+}
+
+// use wsc as the current connection and make it available for new proxy connections.
+// It returns false if the supervisor is closed.
+func (s *connSupervisor) onConnected(wsc *wss.WebSocketClient) bool {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = wsc.Close()
+		return false
+	}
+	s.wsc = wsc
+	close(s.ready)
+	s.mu.Unlock()
+	notifyConnState(StateConnected, nil)
+	return true
+}
+
+// create a new websocket connection and negotiate version with server.
+func (s *connSupervisor) dial() (*wss.WebSocketClient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	wsc, err := s.hdl.dialServer(s.options, ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if s.wsc != nil {
+		wsc.ResumeFrom(s.wsc) // try to resume the session of the lost connection
+	}
+	s.mu.Unlock()
+	if err := s.hdl.negotiateVersion(ctx, wsc, s.options.RemoteUrl.String()); err != nil {
+		_ = wsc.Close()
+		return nil, err
+	}
+	return wsc, nil
+}
+
+func (s *connSupervisor) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// close stops reconnecting, and closes the current websocket connection.
+func (s *connSupervisor) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.stop)
+	if s.hb != nil {
+		s.hb.Close()
+	}
+	if s.wsc != nil {
+		_ = s.wsc.Close()
+	}
+}
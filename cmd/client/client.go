@@ -13,6 +13,7 @@ import (
 
 	"github.com/genshen/cmds"
 	cl "github.com/genshen/wssocks/client"
+	"github.com/genshen/wssocks/wss"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -43,13 +44,37 @@ func init() {
 	clientCommand.FlagSet = fs
 	clientCommand.FlagSet.StringVar(&client.address, "addr", ":1080", `listen address of socks5 proxy.`)
 	clientCommand.FlagSet.BoolVar(&client.http, "http", false, `enable http and https proxy.`)
-	clientCommand.FlagSet.StringVar(&client.httpAddr, "http-addr", ":1086", `listen address of http proxy (if enabled).`)
+	clientCommand.FlagSet.StringVar(&client.httpAddr, "http-addr", ":1086", `listen address of http proxy (if enabled), plain http proxy requests are also accepted on socks5 listen address.
+Empty for serving http proxy on socks5 listen address only.`)
 	clientCommand.FlagSet.StringVar(&client.remote, "remote", "", `server address and port(e.g: ws://example.com:1088).`)
 	clientCommand.FlagSet.StringVar(&client.key, "key", "", `connection key.`)
 	clientCommand.FlagSet.Var(&client.headers, "ws-header", `list of user defined http headers in websocket request. 
 (e.g: --ws-header "X-Custom-Header=some-value" --ws-header "X-Second-Header=another-value")`)
 	clientCommand.FlagSet.BoolVar(&client.skipTLSVerify, "skip-tls-verify", false, `skip verification of the server's certificate chain and host name.`)
+	client.reconnect = cl.DefaultReconnectOptions()
+	clientCommand.FlagSet.BoolVar(&client.reconnect.Enable, "reconnect", client.reconnect.Enable, `reconnect to server if the connection is lost.`)
+	clientCommand.FlagSet.DurationVar(&client.reconnect.InitialDelay, "reconnect-delay", client.reconnect.InitialDelay, `delay before the first reconnecting, it grows exponentially in the next retries.`)
+	clientCommand.FlagSet.DurationVar(&client.reconnect.MaxDelay, "reconnect-max-delay", client.reconnect.MaxDelay, `max delay between two reconnecting retries.`)
+	clientCommand.FlagSet.Float64Var(&client.reconnect.Jitter, "reconnect-jitter", client.reconnect.Jitter, `randomization factor (0 to 1) applied to the reconnecting delay.`)
+	clientCommand.FlagSet.IntVar(&client.reconnect.MaxRetries, "reconnect-max-retries", client.reconnect.MaxRetries, `max reconnecting retries (0 for unlimited).`)
+	clientCommand.FlagSet.IntVar(&client.connections, "connections", 1, `count of websocket connections to server, proxy connections are spread across them.`)
+	clientCommand.FlagSet.StringVar(&client.poolStrategy, "pool-strategy", cl.PoolLeastLoaded.String(), `strategy to pick a websocket connection for a new proxy connection ("least-loaded" or "round-robin").`)
+	clientCommand.FlagSet.BoolVar(&client.compress, "compress", false, `compress data between client and server (if server accepts it).`)
+	clientCommand.FlagSet.IntVar(&client.compressThreshold, "compress-threshold", wss.DefaultCompressThreshold, `min size in bytes of data to be compressed.`)
 
+	clientCommand.FlagSet.Var(&client.socks5Users, "socks5-user", `username and password accepted by socks5 authentication, it can be specified multiple times.
+(e.g: --socks5-user "alice:secret" --socks5-user "bob:another-secret")`)
+	clientCommand.FlagSet.StringVar(&client.socks5CredFile, "socks5-credentials", "", `file of socks5 users, one "username:password" per line.`)
+	clientCommand.FlagSet.Var(&client.httpUsers, "http-user", `username and password accepted by http(s) proxy Basic authentication, it can be specified multiple times.`)
+	clientCommand.FlagSet.StringVar(&client.httpCredFile, "http-credentials", "", `file of http(s) proxy users, one "username:password" per line.`)
+	clientCommand.FlagSet.BoolVar(&client.httpVia, "http-via", false, `add Via header to the requests forwarded by http proxy.`)
+	clientCommand.FlagSet.BoolVar(&client.httpForwardedFor, "http-forwarded-for", false, `add X-Forwarded-For header (address of the http proxy client) to the requests forwarded by http proxy.`)
+	clientCommand.FlagSet.BoolVar(&client.pac, "pac", false, `serve proxy auto-config script at `+wss.PacPath+` of http listen address (http proxy must be enabled).`)
+	clientCommand.FlagSet.Var(&client.pacDirect, "pac-direct", `domain (including subdomains) or ipv4 CIDR connected directly in proxy auto-config script, it can be specified multiple times.
+(e.g: --pac-direct "example.com" --pac-direct "10.0.0.0/8")`)
+	clientCommand.FlagSet.StringVar(&client.transparentAddr, "transparent-addr", "", `listen address of transparent proxy (linux only), for connections redirected by iptables/nftables REDIRECT or TPROXY rules.`)
+	clientCommand.FlagSet.Var(&client.forwardSpecs, "forward", `static port forwarding "local_addr=remote_host:port[/udp]" via server (tcp by default), it can be specified multiple times.
+(e.g: --forward "5432=db.internal:5432" --forward "127.0.0.1:5353=10.0.0.1:53/udp")`)
 	clientCommand.FlagSet.Usage = clientCommand.Usage // use default usage provided by cmds.Command.
 	clientCommand.Runner = &client
 
@@ -57,15 +82,35 @@ func init() {
 }
 
 type client struct {
-	address       string      // local listening address
-	http          bool        // enable http and https proxy
-	httpAddr      string      // listen address of http and https(if it is enabled)
-	remote        string      // string usr of server
-	remoteUrl     *url.URL    // url of server
-	headers       listFlags   // websocket headers passed from user.
-	remoteHeaders http.Header // parsed websocket headers (not presented in flag).
-	key           string
-	skipTLSVerify bool
+	address           string      // local listening address
+	http              bool        // enable http and https proxy
+	httpAddr          string      // listen address of http and https(if it is enabled)
+	remote            string      // string usr of server
+	remoteUrl         *url.URL    // url of server
+	headers           listFlags   // websocket headers passed from user.
+	remoteHeaders     http.Header // parsed websocket headers (not presented in flag).
+	key               string
+	skipTLSVerify     bool
+	reconnect         cl.ReconnectOptions // options of reconnecting to server
+	connections       int                 // count of websocket connections to server
+	poolStrategy      string              // strategy to pick a websocket connection
+	strategy          cl.PoolStrategy     // parsed pool strategy
+	compress          bool                // ask server for compression
+	compressThreshold int                 // min size of data to be compressed
+	socks5Users       listFlags           // socks5 users passed from user
+	socks5CredFile    string              // file of socks5 users
+	socks5Credentials wss.Credentials
+	httpUsers         listFlags // http(s) proxy users passed from user
+	httpCredFile      string    // file of http(s) proxy users
+	httpCredentials   wss.Credentials
+	httpVia           bool      // add Via header to forwarded http requests
+	httpForwardedFor  bool      // add X-Forwarded-For header to forwarded http requests
+	pac               bool      // serve proxy auto-config script
+	pacDirect         listFlags // direct-connect exceptions in proxy auto-config script
+	pacScript         *wss.Pac
+	transparentAddr   string       // listen address of transparent proxy
+	forwardSpecs      listFlags    // port forwardings passed from user
+	forwards          []cl.Forward // parsed port forwardings
 }
 
 func (c *client) PreRun() error {
@@ -85,6 +130,68 @@ func (c *client) PreRun() error {
 		log.Info("http(s) proxy is disabled.")
 	}
 
+	if c.reconnect.Jitter < 0 || c.reconnect.Jitter > 1 {
+		return errors.New("reconnect jitter must be in range [0, 1]")
+	}
+
+	if c.connections < 1 {
+		return errors.New("connections must be at least 1")
+	}
+	if strategy, err := cl.ParsePoolStrategy(c.poolStrategy); err != nil {
+		return err
+	} else {
+		c.strategy = strategy
+	}
+
+	// socks5 authentication
+	c.socks5Credentials = make(wss.Credentials)
+	for _, user := range c.socks5Users {
+		if err := c.socks5Credentials.Add(user); err != nil {
+			return err
+		}
+	}
+	if c.socks5CredFile != "" {
+		if err := c.socks5Credentials.Load(c.socks5CredFile); err != nil {
+			return err
+		}
+	}
+	if err := c.socks5Credentials.CheckSocks5(); err != nil {
+		return err
+	}
+	// proxy auto-config
+	if c.pac {
+		if !c.http || c.httpAddr == "" {
+			return errors.New("proxy auto-config is served on http listen address, which is not enabled (see --http and --http-addr)")
+		}
+		pac, err := wss.NewPac(c.address, c.httpAddr, c.pacDirect)
+		if err != nil {
+			return err
+		}
+		c.pacScript = pac
+	}
+
+	// http(s) proxy authentication
+	c.httpCredentials = make(wss.Credentials)
+	for _, user := range c.httpUsers {
+		if err := c.httpCredentials.Add(user); err != nil {
+			return err
+		}
+	}
+	if c.httpCredFile != "" {
+		if err := c.httpCredentials.Load(c.httpCredFile); err != nil {
+			return err
+		}
+	}
+
+	// port forwarding
+	for _, spec := range c.forwardSpecs {
+		forward, err := cl.ParseForward(spec)
+		if err != nil {
+			return err
+		}
+		c.forwards = append(c.forwards, forward)
+	}
+
 	// check header format.
 	c.remoteHeaders = make(http.Header)
 	for _, header := range c.headers {
@@ -106,13 +213,25 @@ func (c *client) Run() error {
 	}).Info("connecting to wssocks server.")
 
 	options := cl.Options{
-		LocalSocks5Addr: c.address,
-		HttpEnabled:     c.http,
-		LocalHttpAddr:   c.httpAddr,
-		RemoteUrl:       c.remoteUrl,
-		RemoteHeaders:   c.remoteHeaders,
-		ConnectionKey:   c.key,
-		SkipTLSVerify:   c.skipTLSVerify,
+		LocalSocks5Addr:   c.address,
+		HttpEnabled:       c.http,
+		LocalHttpAddr:     c.httpAddr,
+		RemoteUrl:         c.remoteUrl,
+		RemoteHeaders:     c.remoteHeaders,
+		ConnectionKey:     c.key,
+		SkipTLSVerify:     c.skipTLSVerify,
+		Reconnect:         c.reconnect,
+		Connections:       c.connections,
+		PoolStrategy:      c.strategy,
+		Compression:       c.compress,
+		CompressThreshold: c.compressThreshold,
+		Socks5Credentials: c.socks5Credentials,
+		HttpCredentials:   c.httpCredentials,
+		HttpVia:           c.httpVia,
+		HttpForwardedFor:  c.httpForwardedFor,
+		Pac:               c.pacScript,
+		TransparentAddr:   c.transparentAddr,
+		Forwards:          c.forwards,
 	}
 	hdl := cl.NewClientHandles()
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute) // fixme
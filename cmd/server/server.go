@@ -6,6 +6,7 @@ import (
 	"flag"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/genshen/cmds"
 	_ "github.com/genshen/wssocks/cmd/server/statik"
@@ -36,6 +37,21 @@ func init() {
 	serverCommand.FlagSet.StringVar(&s.tlsCertFile, "tls-cert-file", "", "path of certificate file if HTTPS/tls is enabled.")
 	serverCommand.FlagSet.StringVar(&s.tlsKeyFile, "tls-key-file", "", "path of private key file if HTTPS/tls is enabled.")
 	serverCommand.FlagSet.BoolVar(&s.status, "status", false, `enable/disable service status page.`)
+	serverCommand.FlagSet.DurationVar(&s.sessionGrace, "session-grace", wss.DefaultSessionGrace,
+		"time to keep proxy connections of a disconnected client for resuming, 0 for disabling session resuming.")
+	serverCommand.FlagSet.BoolVar(&s.compress, "compress", true, "accept compressing data if client asks for it.")
+	serverCommand.FlagSet.IntVar(&s.compressThreshold, "compress-threshold", wss.DefaultCompressThreshold, "min size in bytes of data to be compressed.")
+	serverCommand.FlagSet.DurationVar(&s.udpIdleTimeout, "udp-idle-timeout", wss.DefaultUdpIdleTimeout, "time to keep a socks5 udp association without any datagram.")
+	serverCommand.FlagSet.BoolVar(&s.bind, "bind", false, "accept socks5 BIND requests, which listen on tcp ports of server for clients.")
+	s.upstream = wss.DefaultUpstreamConfig
+	serverCommand.FlagSet.DurationVar(&s.upstream.DialTimeout, "upstream-dial-timeout", s.upstream.DialTimeout, "timeout of connecting to a proxy target.")
+	serverCommand.FlagSet.DurationVar(&s.upstream.ResponseHeaderTimeout, "upstream-response-timeout", s.upstream.ResponseHeaderTimeout, "time to wait for the response header of http proxy (0 for no timeout).")
+	serverCommand.FlagSet.DurationVar(&s.upstream.IdleConnTimeout, "upstream-idle-timeout", s.upstream.IdleConnTimeout, "time to keep an idle connection of http proxy for reusing.")
+	serverCommand.FlagSet.IntVar(&s.upstream.MaxIdleConns, "upstream-idle-conns", s.upstream.MaxIdleConns, "max idle connections of http proxy (0 for no limit).")
+	serverCommand.FlagSet.IntVar(&s.upstream.MaxIdleConnsPerHost, "upstream-idle-conns-per-host", s.upstream.MaxIdleConnsPerHost, "max idle connections of http proxy per host.")
+	serverCommand.FlagSet.BoolVar(&s.upstream.EnableHTTP2, "upstream-http2", s.upstream.EnableHTTP2, "try HTTP/2 for https urls of http proxy.")
+	serverCommand.FlagSet.BoolVar(&s.upstream.ProxyFromEnvironment, "upstream-proxy-env", s.upstream.ProxyFromEnvironment,
+		"send http proxy requests via the proxy given by HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.")
 	serverCommand.FlagSet.Usage = serverCommand.Usage // use default usage provided by cmds.Command.
 
 	serverCommand.Runner = &s
@@ -43,15 +59,22 @@ func init() {
 }
 
 type server struct {
-	address     string
-	wsBasePath  string // base path for serving websocket and status page
-	http        bool   // enable http and https proxy
-	authEnable  bool   // enable authentication connection key
-	authKey     string // the connection key if authentication is enabled
-	tls         bool   // enable/disable HTTPS/tls support of server.
-	tlsCertFile string // path of certificate file if HTTPS/tls is enabled.
-	tlsKeyFile  string // path of private key file if HTTPS/tls is enabled.
-	status      bool   // enable service status page
+	address           string
+	wsBasePath        string        // base path for serving websocket and status page
+	http              bool          // enable http and https proxy
+	authEnable        bool          // enable authentication connection key
+	authKey           string        // the connection key if authentication is enabled
+	tls               bool          // enable/disable HTTPS/tls support of server.
+	tlsCertFile       string        // path of certificate file if HTTPS/tls is enabled.
+	tlsKeyFile        string        // path of private key file if HTTPS/tls is enabled.
+	status            bool          // enable service status page
+	sessionGrace      time.Duration // time to keep proxy connections of a disconnected client for resuming.
+	compress          bool          // accept compression if client asks for it.
+	compressThreshold int           // min size of data to be compressed.
+	udpIdleTimeout    time.Duration // time to keep a socks5 udp association without any datagram.
+	bind              bool          // accept socks5 BIND requests.
+	// policy of connecting to proxy targets.
+	upstream wss.UpstreamConfig
 }
 
 func genRandBytes(n int) ([]byte, error) {
@@ -88,7 +111,9 @@ func (s *server) PreRun() error {
 }
 
 func (s *server) Run() error {
-	config := wss.WebsocksServerConfig{EnableHttp: s.http, EnableConnKey: s.authEnable, ConnKey: s.authKey, EnableStatusPage: s.status}
+	config := wss.WebsocksServerConfig{EnableHttp: s.http, EnableConnKey: s.authEnable, ConnKey: s.authKey, EnableStatusPage: s.status,
+		SessionGrace: s.sessionGrace, EnableCompression: s.compress, CompressThreshold: s.compressThreshold,
+		UdpIdleTimeout: s.udpIdleTimeout, EnableBind: s.bind, Dialer: s.upstream.Dialer(), HttpTransport: s.upstream.Transport()}
 	hc := wss.NewHubCollection()
 
 	http.Handle(s.wsBasePath, wss.NewServeWS(hc, config))
@@ -27,6 +27,8 @@ func (h *BufferedWR) Close() error {
 }
 
 func (h *BufferedWR) isClosed() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	return h.done
 }
 
@@ -41,31 +43,34 @@ func (h *BufferedWR) Write(p []byte) (int, error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
-	if h.buffer.Len() == 0 {
-		h.update <- struct{}{}
+	n, err := h.buffer.Write(p)
+	// wake up the reader if it is waiting, never block here.
+	select {
+	case h.update <- struct{}{}:
+	default:
 	}
-	return h.buffer.Write(p)
+	return n, err
 }
 
-// read data from buffer
+// read data from buffer, the buffered data can still be read after closing.
 // make sure there is no more one goroutine reading
 func (h *BufferedWR) Read(p []byte) (int, error) {
-	// wait to make sure there is data in buffer
-	if h.buffer.Len() == 0 {
-		select {
-		case _, ok := <-h.update: // data received from client
-			if !ok {
-				return 0, io.EOF
-			}
+	for {
+		h.mu.Lock()
+		if h.buffer.Len() != 0 {
+			n, err := h.buffer.Read(p)
+			h.mu.Unlock()
+			return n, err
 		}
-	}
+		if h.done {
+			h.mu.Unlock()
+			return 0, io.EOF
+		}
+		h.mu.Unlock()
 
-	h.mu.Lock()
-	defer h.mu.Unlock()
-	if h.done {
-		return 0, io.EOF
+		// wait to make sure there is data in buffer (or the buffer is closed)
+		<-h.update
 	}
-	return h.buffer.Read(p)
 }
 
 func NewBufferWR() *BufferedWR {
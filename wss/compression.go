@@ -0,0 +1,128 @@
+package wss
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+)
+
+// CompressionFlate is the codec compressing data frames by DEFLATE (RFC 1951).
+const CompressionFlate = "flate"
+
+// DefaultCompressThreshold is the default min size of data to be compressed,
+// small payloads are hardly compressible and not worth the cost.
+const DefaultCompressThreshold = 256
+
+// max size of the decompressed payload of a frame, to protect from compression bombs.
+const maxInflateSize = 1 << 24
+
+var ErrInflateTooLarge = errors.New("decompressed frame is too large")
+
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// CompressionStats is the statistics of data frames on a websocket,
+// raw bytes are the proxy data before compression (or after decompression),
+// and wire bytes are the payloads actually transferred.
+type CompressionStats struct {
+	SentRaw  uint64 `json:"sent_raw"`
+	SentWire uint64 `json:"sent_wire"`
+	RecvRaw  uint64 `json:"recv_raw"`
+	RecvWire uint64 `json:"recv_wire"`
+}
+
+// Ratio returns the compression ratio (wire bytes / raw bytes) of data in both directions.
+// It returns 1 if no data is transferred.
+func (s CompressionStats) Ratio() float64 {
+	if s.SentRaw+s.RecvRaw == 0 {
+		return 1
+	}
+	return float64(s.SentWire+s.RecvWire) / float64(s.SentRaw+s.RecvRaw)
+}
+
+// Add returns the sum of two statistics.
+func (s CompressionStats) Add(o CompressionStats) CompressionStats {
+	return CompressionStats{
+		SentRaw:  s.SentRaw + o.SentRaw,
+		SentWire: s.SentWire + o.SentWire,
+		RecvRaw:  s.RecvRaw + o.RecvRaw,
+		RecvWire: s.RecvWire + o.RecvWire,
+	}
+}
+
+// compressor compresses data frames sent to websocket, and records the statistics.
+type compressor struct {
+	stats     CompressionStats // first field, for 64-bit alignment of atomic operations
+	codec     string
+	threshold int // min size of data to be compressed
+}
+
+func newCompressor(codec string, threshold int) *compressor {
+	if threshold <= 0 {
+		threshold = DefaultCompressThreshold
+	}
+	return &compressor{codec: codec, threshold: threshold}
+}
+
+// compress data if it is worth, it returns the payload to be sent and whether it is compressed.
+func (c *compressor) compress(data []byte) ([]byte, bool) {
+	atomic.AddUint64(&c.stats.SentRaw, uint64(len(data)))
+	if len(data) < c.threshold || isTLSRecord(data) {
+		atomic.AddUint64(&c.stats.SentWire, uint64(len(data)))
+		return data, false
+	}
+
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil || w.Close() != nil || buf.Len() >= len(data) {
+		// incompressible data
+		atomic.AddUint64(&c.stats.SentWire, uint64(len(data)))
+		return data, false
+	}
+	atomic.AddUint64(&c.stats.SentWire, uint64(buf.Len()))
+	return buf.Bytes(), true
+}
+
+// record a received data frame, raw is the size of decompressed data and wire is the payload size.
+func (c *compressor) onReceived(raw, wire int) {
+	atomic.AddUint64(&c.stats.RecvRaw, uint64(raw))
+	atomic.AddUint64(&c.stats.RecvWire, uint64(wire))
+}
+
+func (c *compressor) statistics() CompressionStats {
+	return CompressionStats{
+		SentRaw:  atomic.LoadUint64(&c.stats.SentRaw),
+		SentWire: atomic.LoadUint64(&c.stats.SentWire),
+		RecvRaw:  atomic.LoadUint64(&c.stats.RecvRaw),
+		RecvWire: atomic.LoadUint64(&c.stats.RecvWire),
+	}
+}
+
+// decompress the payload of a compressed data frame.
+func inflate(payload []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(payload))
+	defer r.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxInflateSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxInflateSize {
+		return nil, ErrInflateTooLarge
+	}
+	return data, nil
+}
+
+// whether data starts with a TLS record header, whose content is encrypted and incompressible.
+func isTLSRecord(data []byte) bool {
+	return len(data) >= 3 && data[0] >= 0x14 && data[0] <= 0x17 && data[1] == 0x03 && data[2] <= 0x04
+}
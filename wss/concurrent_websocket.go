@@ -3,10 +3,11 @@ package wss
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"github.com/segmentio/ksuid"
 	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 	"sync"
+	"time"
 )
 
 type ConcurrentWebSocketInterface interface {
@@ -14,27 +15,273 @@ type ConcurrentWebSocketInterface interface {
 	WriteWSJSON(data interface{}) error
 }
 
-// add lock to websocket connection to make sure only one goroutine can write this websocket.
+// websocket connection shared by many proxy connections.
+// All messages are written by a single writer from the send queue, thus only one goroutine writes this websocket.
 type ConcurrentWebSocket struct {
 	WsConn *websocket.Conn
+	connMu sync.RWMutex // lock for replacing WsConn when resuming session
+	binary bool         // use binary frame (negotiated with the peer) instead of json message
+	// receive window size of each stream advertised by the peer, 0 means flow control is disabled.
+	peerWindow uint32
+	session    *session  // resumable session, nil if session resuming is not negotiated.
+	resumed    bool      // the session is resumed in version negotiation (client side)
+	resumeSeq  uint64    // count of frames received by server in the resumed session (client side)
+	queue      sendQueue // all outgoing frames go through this queue, and are written by a single writer.
+	// compressor of data frames, nil if compression is not negotiated.
+	compression *compressor
+	features    []string // negotiated features, nil if the peer does not support feature negotiation
 }
 
 // close websocket connection
 func (wsc *ConcurrentWebSocket) WSClose() error {
-	return wsc.WsConn.Close(websocket.StatusNormalClosure, "")
+	return wsc.conn().Close(websocket.StatusNormalClosure, "")
+}
+
+// Conn returns the current websocket connection.
+func (wsc *ConcurrentWebSocket) Conn() *websocket.Conn {
+	return wsc.conn()
+}
+
+func (wsc *ConcurrentWebSocket) conn() *websocket.Conn {
+	wsc.connMu.RLock()
+	defer wsc.connMu.RUnlock()
+	return wsc.WsConn
+}
+
+func (wsc *ConcurrentWebSocket) setConn(conn *websocket.Conn) {
+	wsc.connMu.Lock()
+	defer wsc.connMu.Unlock()
+	wsc.WsConn = conn
+}
+
+// Resumable returns true if the proxy connections can survive a reconnection of the websocket.
+func (wsc *ConcurrentWebSocket) Resumable() bool {
+	return wsc.session != nil
+}
+
+// write encoded message of stream id to websocket.
+// The message is put into the send queue, and it returns after the message is written by the writer.
+func (wsc *ConcurrentWebSocket) write(ctx context.Context, id ksuid.KSUID, tp string, msgType websocket.MessageType, data []byte) error {
+	f := &queuedFrame{ctx: ctx, id: id, tp: tp, msgType: msgType, data: data, done: make(chan error, 1)}
+	if wsc.queue.push(f) {
+		go wsc.sendLoop()
+	}
+	select {
+	case err := <-f.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// the single writer of websocket, it writes frames in the send queue until the queue is empty.
+func (wsc *ConcurrentWebSocket) sendLoop() {
+	for f := wsc.queue.pop(); f != nil; f = wsc.queue.pop() {
+		if err := f.ctx.Err(); err != nil {
+			f.done <- err // the writing is canceled by the caller.
+			continue
+		}
+		f.done <- wsc.writeFrame(f)
+	}
+}
+
+// write a frame to websocket connection.
+// If session is resumable, the frame is numbered and kept for resending.
+func (wsc *ConcurrentWebSocket) writeFrame(f *queuedFrame) error {
+	if wsc.session != nil && isSessionFrame(f.tp) {
+		return wsc.session.write(f.ctx, wsc, f.msgType, f.data)
+	}
+	return wsc.conn().Write(f.ctx, f.msgType, f.data)
+}
+
+// onFrameReceived is called after a frame is received,
+// it starts sending an ack message to the peer if needed, when session is resumable.
+func (wsc *ConcurrentWebSocket) onFrameReceived(frame *Frame) error {
+	if wsc.session != nil && frame.Type == WsTpAck {
+		var ack SessionAck
+		if err := json.Unmarshal(frame.Body, &ack); err != nil {
+			return err
+		}
+		wsc.session.onAck(ack.Seq)
+		return nil
+	}
+	if wsc.compression != nil && frame.Type == WsTpData {
+		wire := frame.wire
+		if wire == 0 { // not compressed
+			wire = len(frame.Data)
+		}
+		wsc.compression.onReceived(len(frame.Data), wire)
+	}
+	if wsc.session == nil || !isSessionFrame(frame.Type) {
+		return nil
+	}
+	if wsc.session.onReceived() {
+		go wsc.sendAcks()
+	}
+	return nil
+}
+
+// write ack messages of the session.
+// It runs out of the read loop, so that reading never waits for the writer (the peer may be waiting for us to read),
+// and the frames received meanwhile are acknowledged by one combined ack message.
+func (wsc *ConcurrentWebSocket) sendAcks() {
+	for {
+		seq := wsc.session.received()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := wsc.WriteMessage(ctx, ksuid.Nil, WsTpAck, SessionAck{Seq: seq})
+		cancel()
+		if !wsc.session.onAckSent(seq, err == nil) {
+			return
+		}
+	}
+}
+
+// Features returns the features supported by both sides of the websocket.
+// It is nil if the peer is older than feature negotiation.
+func (wsc *ConcurrentWebSocket) Features() []string {
+	return wsc.features
+}
+
+// HasFeature returns true if the feature is negotiated on this websocket.
+func (wsc *ConcurrentWebSocket) HasFeature(feature string) bool {
+	return HasFeature(wsc.features, feature)
+}
+
+// SetCompression enables compressing data frames by codec (e.g. CompressionFlate),
+// only data larger than threshold (0 for DefaultCompressThreshold) is compressed.
+// Empty codec disables compression.
+// On client side, it is called before version negotiation to ask server for compression.
+func (wsc *ConcurrentWebSocket) SetCompression(codec string, threshold int) {
+	if codec == "" {
+		wsc.compression = nil
+		return
+	}
+	wsc.compression = newCompressor(codec, threshold)
+}
+
+// Compression returns the negotiated codec of compression, or empty string if compression is disabled.
+func (wsc *ConcurrentWebSocket) Compression() string {
+	if wsc.compression == nil {
+		return ""
+	}
+	return wsc.compression.codec
+}
+
+// CompressionStats returns the statistics of data frames compression on this websocket.
+func (wsc *ConcurrentWebSocket) CompressionStats() CompressionStats {
+	if wsc.compression == nil {
+		return CompressionStats{}
+	}
+	return wsc.compression.statistics()
+}
+
+// SetBinaryFrame enables or disables binary frame format.
+// It should be called after version negotiation and before any proxy message is written.
+func (wsc *ConcurrentWebSocket) SetBinaryFrame(enable bool) {
+	wsc.binary = enable
+}
+
+// IsBinaryFrame returns true if binary frame format is used on this websocket.
+func (wsc *ConcurrentWebSocket) IsBinaryFrame() bool {
+	return wsc.binary
+}
+
+// SetPeerWindow sets the stream receive window size advertised by the peer.
+// Flow control is enabled if the size is not 0.
+func (wsc *ConcurrentWebSocket) SetPeerWindow(size uint32) {
+	wsc.peerWindow = size
+}
+
+// FlowControlEnabled returns true if per-stream flow control is negotiated on this websocket.
+func (wsc *ConcurrentWebSocket) FlowControlEnabled() bool {
+	return wsc.peerWindow != 0
+}
+
+// create the send window for a new stream, it is nil if flow control is disabled.
+func (wsc *ConcurrentWebSocket) newSendWindow() *sendWindow {
+	return newSendWindow(wsc.peerWindow)
+}
+
+// tell the peer the total consumed data size on stream id.
+func (wsc *ConcurrentWebSocket) WriteWindowUpdate(id ksuid.KSUID, consumed uint64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return wsc.WriteMessage(ctx, id, WsTpWindow, ProxyWindow{Consumed: consumed})
+}
+
+// create a receive buffer for stream id, it returns nil if flow control is disabled.
+func (wsc *ConcurrentWebSocket) newFlowReceiver(id ksuid.KSUID) *flowReceiver {
+	if !wsc.FlowControlEnabled() {
+		return nil
+	}
+	return newFlowReceiver(func(consumed uint64) error {
+		return wsc.WriteWindowUpdate(id, consumed)
+	})
 }
 
 // write message to websocket, the data is fixed format @ProxyData
 // id: connection id
 // data: data to be written
 func (wsc *ConcurrentWebSocket) WriteProxyMessage(ctx context.Context, id ksuid.KSUID, tag int, data []byte) error {
+	if wsc.binary {
+		if wsc.compression != nil {
+			if payload, ok := wsc.compression.compress(data); ok {
+				frame := encodeDataFrameWithFlags(id, tag, frameFlagCompressed, payload)
+				return wsc.write(ctx, id, WsTpData, websocket.MessageBinary, frame)
+			}
+		}
+		return wsc.write(ctx, id, WsTpData, websocket.MessageBinary, encodeDataFrame(id, tag, data))
+	}
 	dataBase64 := base64.StdEncoding.EncodeToString(data)
 	jsonData := WebSocketMessage{
 		Id:   id.String(),
 		Type: WsTpData,
 		Data: ProxyData{Tag: tag, DataBase64: dataBase64},
 	}
-	return wsjson.Write(ctx, wsc.WsConn, &jsonData)
+	if b, err := json.Marshal(&jsonData); err != nil {
+		return err
+	} else {
+		return wsc.write(ctx, id, WsTpData, websocket.MessageText, b)
+	}
+}
+
+// write a udp datagram of stream id to websocket.
+// In json format, the datagram is sent in the same way as proxy data.
+func (wsc *ConcurrentWebSocket) WriteDatagram(ctx context.Context, id ksuid.KSUID, datagram []byte) error {
+	if wsc.binary {
+		return wsc.write(ctx, id, WsTpDatagram, websocket.MessageBinary, encodeDatagramFrame(id, datagram))
+	}
+	jsonData := WebSocketMessage{
+		Id:   id.String(),
+		Type: WsTpDatagram,
+		Data: ProxyData{DataBase64: base64.StdEncoding.EncodeToString(datagram)},
+	}
+	if b, err := json.Marshal(&jsonData); err != nil {
+		return err
+	} else {
+		return wsc.write(ctx, id, WsTpDatagram, websocket.MessageText, b)
+	}
+}
+
+// write a control message (any message type except data) to websocket.
+// body is the message content, which can be nil.
+func (wsc *ConcurrentWebSocket) WriteMessage(ctx context.Context, id ksuid.KSUID, tp string, body interface{}) error {
+	if wsc.binary {
+		if frame, err := encodeControlFrame(id, tp, body); err != nil {
+			return err
+		} else {
+			return wsc.write(ctx, id, tp, websocket.MessageBinary, frame)
+		}
+	}
+	if b, err := json.Marshal(&WebSocketMessage{
+		Id:   id.String(),
+		Type: tp,
+		Data: body,
+	}); err != nil {
+		return err
+	} else {
+		return wsc.write(ctx, id, tp, websocket.MessageText, b)
+	}
 }
 
 type webSocketWriter struct {
@@ -43,6 +290,8 @@ type webSocketWriter struct {
 	Ctx  context.Context
 	Type int // type of trans data.
 	Mu   *sync.Mutex
+	// send window of this stream, writing is blocked if there is no window left.
+	window *sendWindow
 }
 
 func NewWebSocketWriter(wsc *ConcurrentWebSocket, id ksuid.KSUID, ctx context.Context) *webSocketWriter {
@@ -53,6 +302,12 @@ func NewWebSocketWriterWithMutex(wsc *ConcurrentWebSocket, id ksuid.KSUID, ctx c
 	return &webSocketWriter{WSC: wsc, Id: id, Ctx: ctx, Mu: &sync.Mutex{}}
 }
 
+// set send window for flow control, the window can be nil (no flow control).
+func (writer *webSocketWriter) WithWindow(window *sendWindow) *webSocketWriter {
+	writer.window = window
+	return writer
+}
+
 func (writer *webSocketWriter) CloseWsWriter(cancel context.CancelFunc) {
 	if writer.Mu != nil {
 		writer.Mu.Lock()
@@ -70,9 +325,16 @@ func (writer *webSocketWriter) Write(buffer []byte) (n int, err error) {
 	if writer.Ctx.Err() != nil {
 		return 0, writer.Ctx.Err()
 	}
-	if err := writer.WSC.WriteProxyMessage(writer.Ctx, writer.Id, TagData, buffer); err != nil {
-		return 0, err
-	} else {
-		return len(buffer), nil
+	for n < len(buffer) {
+		// wait for the window, then only send the data allowed by the window.
+		size, err := writer.window.acquire(writer.Ctx, len(buffer)-n)
+		if err != nil {
+			return n, err
+		}
+		if err := writer.WSC.WriteProxyMessage(writer.Ctx, writer.Id, TagData, buffer[n:n+size]); err != nil {
+			return n, err
+		}
+		n += size
 	}
+	return n, nil
 }
@@ -13,6 +13,8 @@ type ConnRecord struct {
 	Writer    *io.Writer      // terminal writer  todo defer Flush
 	OnChange  func(status ConnStatus)
 	Mutex     *sync.Mutex
+	// optional, it returns the connection size on each websocket connection if multiple websockets are used.
+	Streams func() []int
 }
 
 // connection status when a connection is added or removed.
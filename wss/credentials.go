@@ -0,0 +1,53 @@
+package wss
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Credentials are username and password pairs accepted by
+// socks5 username/password authentication and Basic authentication of http(s) proxy.
+// Empty credentials means no authentication is required.
+type Credentials map[string]string
+
+// Add parses a credential in form of "username:password" and adds it to c.
+func (c Credentials) Add(credential string) error {
+	index := strings.IndexByte(credential, ':')
+	if index <= 0 {
+		return errors.New("bad credential, expect username:password")
+	}
+	c[credential[:index]] = credential[index+1:]
+	return nil
+}
+
+// Load adds the credentials in file to c.
+// Each line of the file is a "username:password" pair, empty lines and lines starting with '#' are ignored.
+func (c Credentials) Load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if err := c.Add(text); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (c Credentials) verify(user, pass string) bool {
+	expected, ok := c[user]
+	// compare anyway, not to tell whether the user exists by timing.
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(pass)) == 1 && ok
+}
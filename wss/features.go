@@ -0,0 +1,45 @@
+package wss
+
+// feature flags advertised in version negotiation (since version code 0x005).
+// Each side advertises the features it supports, and the features in both lists are used.
+const (
+	FeatureHttpProxy     = "http_proxy"     // http and https proxy
+	FeatureBinaryFrame   = "binary_frame"   // binary frame format, see frame.go
+	FeatureFlowControl   = "flow_control"   // per-stream flow control, the window size is given by VersionNeg.RecvWindow
+	FeatureResume        = "resume"         // resumable session after reconnecting
+	FeatureCompressFlate = "compress_flate" // data frames compressed by CompressionFlate
+	FeatureHalfClose     = "half_close"     // half-close of socks5 and https streams by TagNoMore
+	FeatureUdpAssociate  = "udp_associate"  // socks5 UDP ASSOCIATE, datagrams are sent in WsTpDatagram frames
+	FeatureSocks5Bind    = "socks5_bind"    // socks5 BIND, server listens for the incoming connection
+	FeatureSocks4        = "socks4"         // socks4 and socks4a, server replies in socks4 format
+	FeatureResolve       = "resolve"        // remote dns resolution by WsTpResolve messages
+	FeatureHttpKeepAlive = "http_keepalive" // http proxy responses are delimited, so client connections can be reused
+	FeatureHttpUpgrade   = "http_upgrade"   // upgrade requests of http proxy, relayed in both directions after 101 response
+	FeatureTransparent   = "transparent"    // transparent proxy, server tells client by TagEstOk when the target is connected
+	FeatureForward       = "forward"        // static port forwarding, established in the same way as transparent proxy
+)
+
+// HasFeature returns true if feature is in the feature list.
+func HasFeature(features []string, feature string) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// IntersectFeatures returns the features in both lists.
+// If the peer list is nil (the peer is older than feature negotiation), nil is returned.
+func IntersectFeatures(ours, peer []string) []string {
+	if peer == nil {
+		return nil
+	}
+	common := make([]string, 0, len(ours))
+	for _, f := range ours {
+		if HasFeature(peer, f) {
+			common = append(common, f)
+		}
+	}
+	return common
+}
@@ -0,0 +1,189 @@
+package wss
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// DefaultStreamWindow is the receive window size of each stream (proxy connection) we advertise to the peer.
+// The peer can send at most this size of data which is not consumed yet on a stream.
+const DefaultStreamWindow = 256 * 1024
+
+var ErrWindowClosed = errors.New("send window of stream closed")
+
+// ErrWindowExceeded is returned if the peer sends more data than the receive window on a stream.
+var ErrWindowExceeded = errors.New("data exceeds receive window of stream")
+
+// window update message, sent by data receiver after the data is consumed.
+// Consumed is the total bytes consumed on this stream since it is established,
+// thus, a lost or repeated window update message does no harm.
+type ProxyWindow struct {
+	Consumed uint64 `json:"consumed"`
+}
+
+// sendWindow is the credit-based send window of a stream.
+// A nil sendWindow means flow control is disabled, and sending is never blocked.
+type sendWindow struct {
+	mu       sync.Mutex
+	size     uint64        // window size advertised by the peer
+	sent     uint64        // total bytes sent on this stream
+	consumed uint64        // total bytes consumed by the peer
+	closed   bool          // no more data can be sent after closing
+	update   chan struct{} // closed and renewed on window changing, to wake up the waiting writers.
+}
+
+func newSendWindow(size uint32) *sendWindow {
+	if size == 0 {
+		return nil
+	}
+	return &sendWindow{size: uint64(size), update: make(chan struct{})}
+}
+
+// acquire waits until there is window available and reserves at most want bytes from the window.
+// It returns the reserved size.
+func (w *sendWindow) acquire(ctx context.Context, want int) (int, error) {
+	if w == nil {
+		return want, nil
+	}
+	for {
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return 0, ErrWindowClosed
+		}
+		if avail := w.consumed + w.size - w.sent; avail > 0 {
+			n := uint64(want)
+			if n > avail {
+				n = avail
+			}
+			w.sent += n
+			w.mu.Unlock()
+			return int(n), nil
+		}
+		update := w.update
+		w.mu.Unlock()
+
+		select {
+		case <-update:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// onUpdate is called when window update message is received from the peer.
+func (w *sendWindow) onUpdate(consumed uint64) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if consumed > w.consumed && consumed <= w.sent {
+		w.consumed = consumed
+		w.notify()
+	}
+}
+
+// close the window and wake up all waiting writers.
+func (w *sendWindow) close() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.closed = true
+		w.notify()
+	}
+}
+
+// must be called with lock held
+func (w *sendWindow) notify() {
+	close(w.update)
+	w.update = make(chan struct{})
+}
+
+// flowReceiver buffers the data received from the peer on a stream,
+// so that a slow local reader never blocks the websocket read loop (and other streams).
+// After data is read out from the buffer, the consumed size is reported to the peer via window update message.
+type flowReceiver struct {
+	buffer   *BufferedWR
+	mu       sync.Mutex
+	written  uint64                      // total bytes written into the buffer
+	exceeded bool                        // the peer sent more data than the window
+	consumed uint64                      // total bytes consumed
+	reported uint64                      // consumed size last reported to the peer
+	tell     func(consumed uint64) error // send window update message to the peer, can be nil
+}
+
+// create a flowReceiver, if tell is nil, the consumed size will not be reported,
+// and the buffered size is not limited (the peer sends data without flow control).
+func newFlowReceiver(tell func(consumed uint64) error) *flowReceiver {
+	return &flowReceiver{buffer: NewBufferWR(), tell: tell}
+}
+
+// Write is called in websocket read loop, it only puts data into the buffer.
+// If flow control is used, ErrWindowExceeded is returned when the data not consumed exceeds the window size,
+// then the stream should be reset, and the reader also gets ErrWindowExceeded.
+func (r *flowReceiver) Write(p []byte) (int, error) {
+	if r.tell != nil {
+		r.mu.Lock()
+		r.written += uint64(len(p))
+		if r.written-r.consumed > DefaultStreamWindow {
+			r.exceeded = true
+		}
+		exceeded := r.exceeded
+		r.mu.Unlock()
+		if exceeded {
+			_ = r.buffer.Close() // wake up the reader
+			return 0, ErrWindowExceeded
+		}
+	}
+	return r.buffer.Write(p)
+}
+
+func (r *flowReceiver) Read(p []byte) (int, error) {
+	if r.isExceeded() {
+		return 0, ErrWindowExceeded
+	}
+	n, err := r.buffer.Read(p)
+	if err == io.EOF && r.isExceeded() {
+		return n, ErrWindowExceeded
+	}
+	if n > 0 && r.tell != nil {
+		r.mu.Lock()
+		r.consumed += uint64(n)
+		consumed := r.consumed
+		// report in batch, to reduce the count of window update messages.
+		needTell := consumed-r.reported >= DefaultStreamWindow/4
+		if needTell {
+			r.reported = consumed
+		}
+		r.mu.Unlock()
+		if needTell {
+			if err := r.tell(consumed); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, err
+}
+
+func (r *flowReceiver) isExceeded() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.exceeded
+}
+
+// Close closes the buffer, reader will get io.EOF after all buffered data is read.
+func (r *flowReceiver) Close() error {
+	return r.buffer.Close()
+}
+
+// copy all received data to w until the receiver is closed.
+func (r *flowReceiver) copyTo(w io.Writer) error {
+	_, err := io.Copy(w, r)
+	return err
+}
@@ -0,0 +1,80 @@
+package wss
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSendWindow(t *testing.T) {
+	w := newSendWindow(1024)
+	if n, err := w.acquire(context.Background(), 4096); err != nil || n != 1024 {
+		t.Fatalf("acquire: expect 1024 bytes, but got %d (%v)", n, err)
+	}
+
+	acquired := make(chan int, 1)
+	go func() {
+		n, _ := w.acquire(context.Background(), 4096)
+		acquired <- n
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquire should be blocked if the window is used up")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	w.onUpdate(512)
+	if n := <-acquired; n != 512 {
+		t.Errorf("expect 512 bytes after window update, but got %d", n)
+	}
+	w.onUpdate(512) // repeated update is ignored.
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := w.acquire(ctx, 1); err != context.DeadlineExceeded {
+		t.Errorf("expect deadline exceeded, but got %v", err)
+	}
+
+	w.close()
+	if _, err := w.acquire(context.Background(), 1); err != ErrWindowClosed {
+		t.Errorf("expect window closed error, but got %v", err)
+	}
+}
+
+func TestNilSendWindow(t *testing.T) {
+	var w *sendWindow = newSendWindow(0) // flow control disabled
+	if n, err := w.acquire(context.Background(), 1<<20); err != nil || n != 1<<20 {
+		t.Errorf("nil window should never block, got %d (%v)", n, err)
+	}
+	w.onUpdate(10)
+	w.close()
+}
+
+func TestFlowReceiverWindowExceeded(t *testing.T) {
+	r := newFlowReceiver(func(consumed uint64) error { return nil })
+	chunk := make([]byte, DefaultStreamWindow/2)
+	for i := 0; i < 2; i++ {
+		if _, err := r.Write(chunk); err != nil {
+			t.Fatalf("data within the window is rejected: %v", err)
+		}
+	}
+	// consumed data gives window back.
+	if n, err := r.Read(chunk); err != nil || n != len(chunk) {
+		t.Fatalf("read: %d (%v)", n, err)
+	}
+	if _, err := r.Write(chunk); err != nil {
+		t.Fatalf("data within the window is rejected after consuming: %v", err)
+	}
+	if _, err := r.Write([]byte{0}); err != ErrWindowExceeded {
+		t.Fatalf("expect window exceeded error, but got %v", err)
+	}
+	if _, err := r.Read(chunk); err != ErrWindowExceeded {
+		t.Errorf("reader should get window exceeded error, but got %v", err)
+	}
+
+	// without flow control, the buffered size is not limited.
+	r = newFlowReceiver(nil)
+	if _, err := r.Write(make([]byte, 2*DefaultStreamWindow)); err != nil {
+		t.Errorf("write without flow control: %v", err)
+	}
+}
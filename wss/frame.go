@@ -0,0 +1,184 @@
+package wss
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/segmentio/ksuid"
+	"nhooyr.io/websocket"
+)
+
+// binary frame layout (sent as websocket.MessageBinary):
+//
+//	+------+-------+-----+-----------+----------+
+//	| TYPE | FLAGS | TAG | STREAM ID | PAYLOAD  |
+//	+------+-------+-----+-----------+----------+
+//	|  1   |   1   |  1  |    20     | Variable |
+//	+------+-------+-----+-----------+----------+
+//
+// For data frames, the payload is the raw proxy data,
+// or the compressed proxy data if flag frameFlagCompressed is set.
+// For datagram frames, the payload is the raw datagram (see socks5_udp.go).
+// For other frames, the payload is the json encoded message body,
+// which is the same as the `data` field in the json WebSocketMessage.
+const frameHeaderSize = 3 + ksuidLength
+
+const ksuidLength = 20 // length of ksuid in bytes
+
+// flags of binary frame.
+const frameFlagCompressed = 0x01 // payload of data frame is compressed by the negotiated codec.
+
+var ErrShortFrame = errors.New("binary frame is too short")
+var ErrUnknownFrameType = errors.New("unknown binary frame type")
+var ErrUnexpectedCompression = errors.New("compressed frame received, but compression is not negotiated")
+
+// type codes of binary frame, mapping to the WsTp* message types.
+var frameTypeCodes = map[string]byte{
+	WsTpVer:      0x01,
+	WsTpBeats:    0x02,
+	WsTpClose:    0x03,
+	WsTpData:     0x04,
+	WsTpEst:      0x05,
+	WsTpWindow:   0x06,
+	WsTpAck:      0x07,
+	WsTpDatagram: 0x08,
+	WsTpResolve:  0x09,
+	WsTpResolved: 0x0A,
+}
+
+var frameTypeNames = func() map[byte]string {
+	names := make(map[byte]string, len(frameTypeCodes))
+	for name, code := range frameTypeCodes {
+		names[code] = name
+	}
+	return names
+}()
+
+// Frame is a decoded websocket message, no matter it is received as json text message or binary message.
+type Frame struct {
+	Id   ksuid.KSUID
+	Type string
+	Tag  int
+	Data []byte          // decoded proxy data, only for data and datagram frames.
+	Body json.RawMessage // json message body for other frames (can be empty).
+	wire int             // size of data on wire if the data is compressed, otherwise 0.
+}
+
+// encode a data frame into binary format.
+func encodeDataFrame(id ksuid.KSUID, tag int, data []byte) []byte {
+	return encodeDataFrameWithFlags(id, tag, 0, data)
+}
+
+func encodeDataFrameWithFlags(id ksuid.KSUID, tag int, flags byte, data []byte) []byte {
+	buf := make([]byte, frameHeaderSize+len(data))
+	putFrameHeader(buf, WsTpData, tag, id)
+	buf[1] = flags
+	copy(buf[frameHeaderSize:], data)
+	return buf
+}
+
+// encode a datagram frame into binary format.
+func encodeDatagramFrame(id ksuid.KSUID, datagram []byte) []byte {
+	buf := make([]byte, frameHeaderSize+len(datagram))
+	putFrameHeader(buf, WsTpDatagram, 0, id)
+	copy(buf[frameHeaderSize:], datagram)
+	return buf
+}
+
+// encode a control frame into binary format, body is encoded as json.
+func encodeControlFrame(id ksuid.KSUID, tp string, body interface{}) ([]byte, error) {
+	var payload []byte
+	if body != nil {
+		if b, err := json.Marshal(body); err != nil {
+			return nil, err
+		} else {
+			payload = b
+		}
+	}
+	buf := make([]byte, frameHeaderSize+len(payload))
+	putFrameHeader(buf, tp, 0, id)
+	copy(buf[frameHeaderSize:], payload)
+	return buf, nil
+}
+
+func putFrameHeader(buf []byte, tp string, tag int, id ksuid.KSUID) {
+	buf[0] = frameTypeCodes[tp]
+	buf[1] = 0 // flags, reserved
+	buf[2] = byte(tag)
+	copy(buf[3:frameHeaderSize], id.Bytes())
+}
+
+// parse a binary frame.
+// compressed data frames are only accepted if compression is negotiated.
+// Note: the returned frame may share memory with data.
+func decodeBinaryFrame(data []byte, compression bool) (*Frame, error) {
+	if len(data) < frameHeaderSize {
+		return nil, ErrShortFrame
+	}
+	tp, ok := frameTypeNames[data[0]]
+	if !ok {
+		return nil, ErrUnknownFrameType
+	}
+	id, err := ksuid.FromBytes(data[3:frameHeaderSize])
+	if err != nil {
+		return nil, err
+	}
+	frame := Frame{Id: id, Type: tp, Tag: int(data[2])}
+	if tp == WsTpData || tp == WsTpDatagram {
+		frame.Data = data[frameHeaderSize:]
+		if data[1]&frameFlagCompressed != 0 {
+			if !compression {
+				return nil, ErrUnexpectedCompression
+			}
+			frame.wire = len(frame.Data)
+			if frame.Data, err = inflate(frame.Data); err != nil {
+				return nil, err
+			}
+		}
+	} else if len(data) > frameHeaderSize {
+		frame.Body = data[frameHeaderSize:]
+	}
+	return &frame, nil
+}
+
+// parse a json text message.
+func decodeJsonFrame(data []byte) (*Frame, error) {
+	var socketData json.RawMessage
+	socketStream := WebSocketMessage{
+		Data: &socketData,
+	}
+	if err := json.Unmarshal(data, &socketStream); err != nil {
+		return nil, err
+	}
+
+	// parsing id
+	id, err := ksuid.Parse(socketStream.Id)
+	if err != nil {
+		return nil, err
+	}
+	frame := Frame{Id: id, Type: socketStream.Type}
+	if socketStream.Type == WsTpData || socketStream.Type == WsTpDatagram {
+		var proxyData ProxyData
+		if err := json.Unmarshal(socketData, &proxyData); err != nil {
+			return nil, err
+		}
+		if decodeBytes, err := base64.StdEncoding.DecodeString(proxyData.DataBase64); err != nil {
+			return nil, err
+		} else {
+			frame.Tag = proxyData.Tag
+			frame.Data = decodeBytes
+		}
+	} else {
+		frame.Body = socketData
+	}
+	return &frame, nil
+}
+
+// decode a websocket message into a Frame, based on websocket message type.
+// compression tells whether compression is negotiated on the websocket.
+func decodeFrame(msgType websocket.MessageType, data []byte, compression bool) (*Frame, error) {
+	if msgType == websocket.MessageBinary {
+		return decodeBinaryFrame(data, compression)
+	}
+	return decodeJsonFrame(data)
+}
@@ -0,0 +1,105 @@
+package wss
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/segmentio/ksuid"
+	"nhooyr.io/websocket"
+)
+
+func TestBinaryDataFrame(t *testing.T) {
+	id := ksuid.New()
+	data := []byte("hello wssocks")
+	frame, err := decodeFrame(websocket.MessageBinary, encodeDataFrame(id, TagNoMore, data), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Id != id || frame.Type != WsTpData || frame.Tag != TagNoMore || !bytes.Equal(frame.Data, data) {
+		t.Errorf("decoded frame not match: %+v", frame)
+	}
+}
+
+func TestBinaryDatagramFrame(t *testing.T) {
+	id := ksuid.New()
+	datagram := append(appendSocks5Addr(nil, net.ParseIP("::1"), 53), "query"...)
+	frame, err := decodeFrame(websocket.MessageBinary, encodeDatagramFrame(id, datagram), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Id != id || frame.Type != WsTpDatagram || !bytes.Equal(frame.Data, datagram) {
+		t.Fatalf("decoded frame not match: %+v", frame)
+	}
+	host, port, payload, err := parseSocks5Addr(frame.Data)
+	if err != nil || host != "::1" || port != 53 || string(payload) != "query" {
+		t.Errorf("unexpected datagram: %s %d %q %v", host, port, payload, err)
+	}
+	if _, _, _, err := parseSocks5Addr([]byte{socks5AddrDomain, 9, 'l', 'o'}); err == nil {
+		t.Error("truncated address should not be parsed")
+	}
+}
+
+func TestCompressedDataFrame(t *testing.T) {
+	id := ksuid.New()
+	c := newCompressor(CompressionFlate, 0)
+	data := bytes.Repeat([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n"), 64)
+	payload, ok := c.compress(data)
+	if !ok || len(payload) >= len(data) {
+		t.Fatalf("text data should be compressed, compressed: %v, size: %d", ok, len(payload))
+	}
+	frame, err := decodeFrame(websocket.MessageBinary, encodeDataFrameWithFlags(id, TagData, frameFlagCompressed, payload), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frame.Id != id || !bytes.Equal(frame.Data, data) || frame.wire != len(payload) {
+		t.Errorf("decoded frame not match: %+v", frame)
+	}
+	// compressed frame is rejected if compression is not negotiated.
+	if _, err := decodeFrame(websocket.MessageBinary, encodeDataFrameWithFlags(id, TagData, frameFlagCompressed, payload), false); err != ErrUnexpectedCompression {
+		t.Errorf("expect unexpected compression error, but got %v", err)
+	}
+
+	// small data and tls records are not compressed.
+	if _, ok := c.compress([]byte("hello")); ok {
+		t.Error("data smaller than threshold should not be compressed")
+	}
+	record := append([]byte{0x17, 0x03, 0x03}, bytes.Repeat([]byte{0}, 1024)...)
+	if _, ok := c.compress(record); ok {
+		t.Error("tls record should not be compressed")
+	}
+	if stats := c.statistics(); stats.SentRaw != uint64(len(data)+5+len(record)) || stats.Ratio() >= 1 {
+		t.Errorf("unexpected statistics: %+v", stats)
+	}
+}
+
+func TestBinaryControlFrame(t *testing.T) {
+	id := ksuid.New()
+	b, err := encodeControlFrame(id, WsTpEst, ProxyEstMessage{Type: ProxyTypeHttps, Addr: "example.com:443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := decodeFrame(websocket.MessageBinary, b, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var est ProxyEstMessage
+	if err := json.Unmarshal(frame.Body, &est); err != nil {
+		t.Fatal(err)
+	}
+	if frame.Id != id || frame.Type != WsTpEst || est.Type != ProxyTypeHttps || est.Addr != "example.com:443" {
+		t.Errorf("decoded frame not match: %+v %+v", frame, est)
+	}
+}
+
+func TestBadBinaryFrame(t *testing.T) {
+	if _, err := decodeFrame(websocket.MessageBinary, []byte{0x04, 0x00}, false); err != ErrShortFrame {
+		t.Errorf("expect short frame error, but got %v", err)
+	}
+	b := encodeDataFrame(ksuid.New(), TagData, nil)
+	b[0] = 0xff
+	if _, err := decodeFrame(websocket.MessageBinary, b, false); err != ErrUnknownFrameType {
+		t.Errorf("expect unknown frame type error, but got %v", err)
+	}
+}
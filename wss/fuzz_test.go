@@ -0,0 +1,102 @@
+//go:build go1.18
+// +build go1.18
+
+package wss
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"nhooyr.io/websocket"
+)
+
+// a connection reading from the fuzzing input, and discarding writes.
+type fuzzConn struct {
+	net.Conn // other methods are not used
+	r        io.Reader
+}
+
+func (c *fuzzConn) Read(p []byte) (int, error)        { return c.r.Read(p) }
+func (c *fuzzConn) Write(p []byte) (int, error)       { return len(p), nil }
+func (c *fuzzConn) SetReadDeadline(t time.Time) error { return nil }
+
+func FuzzClientReply(f *testing.F) {
+	f.Add([]byte("\x05\x01\x00\x05\x01\x00\x03\x0bexample.com\x01\xbbhello"))
+	f.Add([]byte("\x05\x01\x02\x01\x05alice\x06secret\x05\x03\x00\x01\x00\x00\x00\x00\x00\x00"))
+	f.Add([]byte("\x05\x01\x00\x05\x02\x00\x04\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x15"))
+	f.Add([]byte("\x04\x01\x00\x50\x00\x00\x00\x01alice\x00example.com\x00GET / HTTP/1.1\r\n\r\n"))
+	f.Add([]byte("CONNECT 127.0.0.1:443 HTTP/1.1\r\nHost: 127.0.0.1:443\r\n\r\n\x16\x03\x01"))
+
+	credentials := Credentials{"alice": "secret"}
+	f.Fuzz(func(t *testing.T, input []byte) {
+		for _, auth := range []bool{false, true} {
+			client := NewClient()
+			if auth {
+				client.SetSocks5Credentials(credentials)
+			}
+			data, proxyType, addr, err := client.Reply(&fuzzConn{r: bytes.NewReader(input)}, true)
+			if err != nil {
+				continue
+			}
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil || host == "" {
+				t.Fatalf("bad address %q: %v", addr, err)
+			}
+			if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+				t.Fatalf("bad port in address %q", addr)
+			}
+			if !bytes.HasSuffix(input, data) {
+				t.Fatalf("establish data %q is not the rest of input", data)
+			}
+
+			switch proxyType {
+			case ProxyTypeSocks5, ProxyTypeSocks5Bind, ProxyTypeSocks5Udp, ProxyTypeSocks5Resolve, ProxyTypeSocks5ResolvePtr:
+				if input[0] != 0x05 {
+					t.Fatalf("socks5 request is parsed from %q", input)
+				}
+				if auth && !bytes.Contains(input, []byte("\x01\x05alice\x06secret")) {
+					t.Fatalf("socks5 request is authenticated without credentials: %q", input)
+				}
+			case ProxyTypeSocks4:
+				if input[0] != 0x04 || auth {
+					t.Fatalf("socks4 request is accepted from %q", input)
+				}
+			case ProxyTypeHttps:
+				if !bytes.HasPrefix(input, []byte("CONNECT ")) {
+					t.Fatalf("CONNECT request is parsed from %q", input)
+				}
+			default:
+				t.Fatalf("unknown proxy type %d", proxyType)
+			}
+		}
+	})
+}
+
+func FuzzDecodeFrame(f *testing.F) {
+	f.Add([]byte(`{"id":"0ujtsYcgvSTl8PAuAdqWYSMnLOv","type":"data","data":{"tag":0,"base64":"aGVsbG8="}}`))
+	f.Add(encodeDataFrame(ksuid.New(), TagData, []byte("hello")))
+	f.Add(encodeDatagramFrame(ksuid.New(), []byte("\x01\x7f\x00\x00\x01\x00\x35query")))
+	f.Fuzz(func(t *testing.T, input []byte) {
+		_, _ = decodeFrame(websocket.MessageBinary, input, true)
+		_, _ = decodeFrame(websocket.MessageText, input, true)
+	})
+}
+
+func FuzzParseSocks5Addr(f *testing.F) {
+	f.Add([]byte("\x03\x0bexample.com\x01\xbbdata"))
+	f.Add([]byte("\x04\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x35"))
+	f.Fuzz(func(t *testing.T, input []byte) {
+		host, port, rest, err := parseSocks5Addr(input)
+		if err != nil {
+			return
+		}
+		if host == "" || port < 0 || port > 65535 || !bytes.HasSuffix(input, rest) {
+			t.Fatalf("bad address parsed from %q: %s %d %q", input, host, port, rest)
+		}
+	})
+}
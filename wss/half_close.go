@@ -0,0 +1,45 @@
+package wss
+
+import (
+	"net"
+	"sync"
+)
+
+// half-close of proxy streams (feature FeatureHalfClose):
+// if one side reads EOF from its local connection, it sends a data frame with tag TagNoMore to the peer,
+// and the peer shuts down the writing side of its local connection after all data received is written.
+// The stream is torn down after both directions are finished, or either side closes the stream.
+
+// peerDrain tracks the data received from the peer of a stream, which is buffered and written to local connection.
+// When the peer closes the stream, the stream is only torn down after the buffered data is written.
+type peerDrain struct {
+	mu      sync.Mutex
+	closed  bool // the stream is closed by the peer
+	drained bool // all data from the peer is written to local connection
+}
+
+// onClosed is called when the peer closes the stream.
+// It returns true if no data from the peer is being written, and the stream can be torn down now.
+func (p *peerDrain) onClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return p.drained
+}
+
+// onDrained is called after all data from the peer is written to local connection.
+// It returns true if the stream is closed by the peer, otherwise the peer only has no more data (half-close).
+func (p *peerDrain) onDrained() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.drained = true
+	return p.closed
+}
+
+// shut down the writing side of conn, if conn supports it.
+func closeWrite(conn net.Conn) error {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return nil
+}
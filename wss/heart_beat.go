@@ -3,7 +3,6 @@ package wss
 import (
 	"context"
 	"github.com/segmentio/ksuid"
-	"nhooyr.io/websocket/wsjson"
 	"time"
 )
 
@@ -39,16 +38,12 @@ func (hb *HeartBeat) Start(ctx context.Context, writeTimeout time.Duration) erro
 		case <-ctx.Done():
 			return nil
 		case <-t.C:
-			heartBeats := WebSocketMessage{
-				Id:   ksuid.KSUID{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}.String(),
-				Type: WsTpBeats,
-				Data: nil,
-			}
-			writeCtx, _ := context.WithTimeout(ctx, writeTimeout)
-			if err := wsjson.Write(writeCtx, hb.wsc.WsConn, heartBeats); err != nil {
+			writeCtx, cancel := context.WithTimeout(ctx, writeTimeout)
+			err := hb.wsc.WriteMessage(writeCtx, ksuid.Nil, WsTpBeats, nil)
+			cancel()
+			if err != nil {
 				return err
 			}
 		}
 	}
-	return nil
 }
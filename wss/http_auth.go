@@ -0,0 +1,41 @@
+package wss
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const proxyAuthorization = "Proxy-Authorization"
+
+// verify the Basic credentials in Proxy-Authorization header of req (see rfc 7617, https://tools.ietf.org/html/rfc7617).
+// Empty credentials means no authentication is required.
+func (c Credentials) verifyProxyAuthorization(req *http.Request) bool {
+	if len(c) == 0 {
+		return true
+	}
+	auth := req.Header.Get(proxyAuthorization)
+	const prefix = "basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth[len(prefix):]))
+	if err != nil {
+		return false
+	}
+	index := strings.IndexByte(string(decoded), ':')
+	if index < 0 {
+		return false
+	}
+	return c.verify(string(decoded[:index]), string(decoded[index+1:]))
+}
+
+// write 407 response to challenge the http proxy client for Basic credentials, and the connection is closed after it.
+func writeHttpAuthRequired(w io.Writer) error {
+	body := "wssocks: proxy authentication required\n"
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nProxy-Authenticate: Basic realm=\"wssocks\"\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		http.StatusProxyAuthRequired, http.StatusText(http.StatusProxyAuthRequired), len(body), body)
+	return err
+}
@@ -1,31 +1,230 @@
 package wss
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"sort"
 	"strings"
 )
 
+// hop-by-hop headers, which are only meaningful for a single connection and not forwarded by proxy,
+// see rfc 7230, section 6.1 (Proxy-Connection is not standard, but still sent by some clients).
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// remove hop-by-hop headers from h, including the headers listed in Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, field := range h["Connection"] {
+		for _, name := range strings.Split(field, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// whether h contains token in the comma-separated values of field name (case-insensitive).
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, field := range h[name] {
+		for _, v := range strings.Split(field, ",") {
+			if strings.EqualFold(textproto.TrimString(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// whether the request with header h asks for upgrading the connection to another protocol (e.g. websocket, h2c),
+// see rfc 7230, section 6.7.
+func isUpgradeRequest(h http.Header) bool {
+	return headerHasToken(h, "Connection", "upgrade") && h.Get("Upgrade") != ""
+}
+
+// remove hop-by-hop headers from h, but keep the headers asking for upgrading to protocol.
+func keepUpgradeHeaders(h http.Header, protocol string) {
+	removeHopHeaders(h)
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", protocol)
+}
+
+// write the request line and the header of req (without hop-by-hop headers) to buffer.
 func HttpRequestHeader(buffer *bytes.Buffer, req *http.Request) {
+	header := req.Header.Clone()
+	removeHopHeaders(header)
+	writeRequestHeader(buffer, req, header, nil)
+}
+
+// write the request line of req and header to buffer.
+// The header fields in names (see peekHeaderNames) are written in the order and case of names.
+func writeRequestHeader(buffer *bytes.Buffer, req *http.Request, header http.Header, names []string) {
 	buffer.WriteString(fmt.Sprintf("%s %s %s\r\n", req.Method, req.URL.String(), req.Proto))
-	//	req.Header.Add("Connection", "close")
-	for name, headers := range req.Header {
-		name = strings.ToLower(name)
-		for _, h := range headers {
-			buffer.WriteString(fmt.Sprintf("%v: %v\r\n", name, h))
-		}
+	if req.Host != "" && header.Get("Host") == "" {
+		header = header.Clone()
+		header.Set("Host", req.Host) // host is removed from header by the parser
 	}
+	writeHeaderFields(buffer, header, names)
 	buffer.WriteString("\r\n")
 }
 
+// write the status line and the header of resp to buffer.
 func HttpRespHeader(buffer *bytes.Buffer, resp *http.Response) {
 	buffer.Write([]byte(fmt.Sprintf("%s %s\r\n", resp.Proto, resp.Status)))
-	//req.Header.Add("Connection", "close")
-	for name, headers := range resp.Header {
-		for _, h := range headers {
-			buffer.Write([]byte(fmt.Sprintf("%s: %s\r\n", name, h)))
+	writeHeaderFields(buffer, resp.Header, nil)
+	buffer.Write([]byte("\r\n"))
+}
+
+// write the fields of header in the order and case of names first, and then the rest fields sorted by name.
+func writeHeaderFields(buffer *bytes.Buffer, header http.Header, names []string) {
+	written := make(map[string]bool, len(header))
+	for _, name := range names {
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		if written[key] {
+			continue
+		}
+		written[key] = true
+		for _, v := range header[key] {
+			buffer.WriteString(fmt.Sprintf("%s: %s\r\n", name, v))
 		}
 	}
-	buffer.Write([]byte("\r\n"))
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		if !written[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, v := range header[key] {
+			buffer.WriteString(fmt.Sprintf("%s: %s\r\n", key, v))
+		}
+	}
+}
+
+// header fields read by http.Transport by their canonical names, whose case can not be restored.
+var transportHeaders = map[string]bool{
+	"Host":              true,
+	"Connection":        true,
+	"Upgrade":           true,
+	"User-Agent":        true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Trailer":           true,
+	"Expect":            true,
+	"Accept-Encoding":   true,
+	"Range":             true,
+}
+
+// restore the names of header fields parsed (and canonicalized) by http parser to the case of names,
+// so that they are sent in the original case by http.Transport.
+func restoreHeaderCase(header http.Header, names []string) {
+	for _, name := range names {
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		if name == key || transportHeaders[key] {
+			continue
+		}
+		if v, ok := header[key]; ok {
+			delete(header, key)
+			header[name] = v
+		}
+	}
+}
+
+// read a http request from r, with the names of its header fields in the original order and case.
+func readRequest(r *bufio.Reader) (*http.Request, []string, error) {
+	names := peekHeaderNames(r)
+	req, err := http.ReadRequest(r)
+	return req, names, err
+}
+
+// names of the header fields of the request at the beginning of r (http parser canonicalizes the names),
+// more data is read into the buffer of r if needed, but nothing is consumed.
+// It returns nil if the header can not be fully buffered by r.
+func peekHeaderNames(r *bufio.Reader) []string {
+	for n := 1; ; n = r.Buffered() + 1 {
+		if _, err := r.Peek(n); err != nil {
+			return nil // the error (if any) is also got by the parser.
+		}
+		buf, _ := r.Peek(r.Buffered())
+		var names []string
+		for first := true; ; first = false {
+			index := bytes.IndexByte(buf, '\n')
+			if index < 0 {
+				break // incomplete header, read more.
+			}
+			line := bytes.TrimSuffix(buf[:index], []byte("\r"))
+			buf = buf[index+1:]
+			if len(line) == 0 {
+				return names // end of header
+			}
+			if first || line[0] == ' ' || line[0] == '\t' {
+				continue // request line or obsolete line folding
+			}
+			if colon := bytes.IndexByte(line, ':'); colon > 0 {
+				names = append(names, string(line[:colon]))
+			}
+		}
+	}
+}
+
+// whether the client connection of req can be reused for the next request after the response.
+// Keep-alive of HTTP/1.0 is not supported.
+func httpKeepAlive(req *http.Request) bool {
+	return !req.Close && req.ProtoAtLeast(1, 1)
+}
+
+// whether the response to a request with method can have a body, see rfc 7230, section 3.3.3.
+func httpBodyAllowed(method string, status int) bool {
+	return method != http.MethodHead && status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// body of req read from r, the reader of the hijacked connection.
+// After hijacking, the original Request.Body must not be used.
+func hijackedBody(req *http.Request, r *bufio.Reader) io.ReadCloser {
+	if len(req.TransferEncoding) > 0 { // "chunked" is the only transfer coding accepted by http server
+		return ioutil.NopCloser(&chunkedBody{r: r, chunked: httputil.NewChunkedReader(r)})
+	}
+	if req.ContentLength > 0 {
+		return ioutil.NopCloser(io.LimitReader(r, req.ContentLength))
+	}
+	return http.NoBody
+}
+
+// chunked body, the trailer after the last chunk is also consumed (and dropped).
+type chunkedBody struct {
+	r       *bufio.Reader
+	chunked io.Reader
+	err     error
+}
+
+func (c *chunkedBody) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.chunked.Read(p)
+	if err == io.EOF {
+		if _, terr := textproto.NewReader(c.r).ReadMIMEHeader(); terr != nil {
+			err = terr
+		}
+	}
+	c.err = err
+	return n, err
 }
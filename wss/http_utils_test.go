@@ -0,0 +1,71 @@
+package wss
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// the body of the first request is read from the connection, and the next request follows it.
+func TestHijackedBody(t *testing.T) {
+	for _, first := range []string{
+		"POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nContent-Length: 5\r\n\r\nhello",
+		"POST http://example.com/ HTTP/1.1\r\nHost: example.com\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhe\r\n3\r\nllo\r\n0\r\nX-Trailer: 1\r\n\r\n",
+	} {
+		r := bufio.NewReader(strings.NewReader(first + "GET http://example.com/next HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(hijackedBody(req, r))
+		if err != nil || string(body) != "hello" {
+			t.Fatalf("body = %q, %v, want %q", body, err, "hello")
+		}
+		next, err := http.ReadRequest(r)
+		if err != nil || next.URL.Path != "/next" {
+			t.Fatalf("next request: %v, %v", next, err)
+		}
+	}
+}
+
+func TestForwardRequestHeader(t *testing.T) {
+	raw := "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nX-lower: a\r\nDNT: 1\r\n" +
+		"Proxy-Connection: keep-alive\r\nConnection: X-Private\r\nX-Private: secret\r\nTE: trailers\r\nAccept: */*\r\n\r\n"
+	r := bufio.NewReader(strings.NewReader(raw))
+	req, names, err := readRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := req.Header.Clone()
+	removeHopHeaders(header)
+	var buf bytes.Buffer
+	writeRequestHeader(&buf, req, header, names)
+
+	want := "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\nX-lower: a\r\nDNT: 1\r\nAccept: */*\r\n\r\n"
+	if buf.String() != want {
+		t.Errorf("forwarded header %q, want %q", buf.String(), want)
+	}
+
+	restoreHeaderCase(header, names)
+	_, canonical := header["Dnt"]
+	if _, ok := header["X-lower"]; !ok || canonical || len(header["DNT"]) != 1 {
+		t.Errorf("header case is not restored: %v", header)
+	}
+}
+
+func TestUpgradeRequest(t *testing.T) {
+	h := http.Header{"Connection": {"keep-alive, Upgrade"}, "Upgrade": {"websocket"}, "Keep-Alive": {"300"}}
+	if !isUpgradeRequest(h) {
+		t.Fatal("upgrade request is not detected")
+	}
+	keepUpgradeHeaders(h, h.Get("Upgrade"))
+	if len(h) != 2 || h.Get("Connection") != "Upgrade" || h.Get("Upgrade") != "websocket" {
+		t.Errorf("upgrade headers: %v", h)
+	}
+	if isUpgradeRequest(http.Header{"Connection": {"keep-alive"}, "Upgrade": {"websocket"}}) {
+		t.Error("not an upgrade request without Connection: Upgrade")
+	}
+}
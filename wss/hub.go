@@ -3,13 +3,15 @@ package wss
 import (
 	"context"
 	"github.com/segmentio/ksuid"
-	"nhooyr.io/websocket/wsjson"
+	"net"
 	"sync"
+	"time"
 )
 
 type ProxyServer struct {
 	Id       ksuid.KSUID // id of proxy connection
 	ProxyIns ProxyEstablish
+	window   *sendWindow // send window for flow control (nil if disabled)
 }
 
 // Hub maintains the set of active proxy clients in server side for a user
@@ -20,6 +22,12 @@ type Hub struct {
 	connPool map[ksuid.KSUID]*ProxyServer
 
 	mu sync.RWMutex
+	// local ip of the current websocket connection, which client can reach, protected by mu.
+	localIP net.IP
+
+	readMu      sync.Mutex  // held while reading messages from the websocket connection
+	gen         int         // attaching generation, protected by the mutex of HubCollection
+	detachTimer *time.Timer // timer to close the hub if it is not reattached, protected by the mutex of HubCollection
 }
 
 type ProxyRegister struct {
@@ -35,10 +43,25 @@ func (h *Hub) Close() {
 	defer h.mu.Unlock()
 	for id, proxy := range h.connPool {
 		proxy.ProxyIns.Close(false)
+		proxy.window.close()
 		delete(h.connPool, id)
 	}
 }
 
+// set the local ip of the websocket connection, when the hub is attached to a connection.
+func (h *Hub) setLocalIP(ip net.IP) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.localIP = ip
+}
+
+// the local ip of the websocket connection, nil if it is unknown.
+func (h *Hub) LocalIP() net.IP {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.localIP
+}
+
 // add a tcp connection to connection pool.
 func (h *Hub) addNewProxy(proxy *ProxyServer) {
 	h.mu.Lock()
@@ -74,21 +97,31 @@ func (h *Hub) CloseProxyConn(id ksuid.KSUID) error {
 func (h *Hub) RemoveProxy(id ksuid.KSUID) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	if _, ok := h.connPool[id]; ok {
+	if proxy, ok := h.connPool[id]; ok {
+		proxy.window.close() // wake up the blocked writer
 		delete(h.connPool, id)
 	}
 }
 
+// create a writer to send data of proxy to the client.
+// The writer is blocked if the send window of proxy is used up.
+func (h *Hub) newProxyWriter(proxy *ProxyServer, ctx context.Context) *webSocketWriter {
+	return NewWebSocketWriter(&h.ConcurrentWebSocket, proxy.Id, ctx).WithWindow(proxy.window)
+}
+
 // tell the client the connection has been closed
 func (h *Hub) tellClosed(id ksuid.KSUID) error {
 	// send finish flag to client
-	finish := WebSocketMessage{
-		Id:   id.String(),
-		Type: WsTpClose,
-		Data: nil,
+	if err := h.WriteMessage(context.TODO(), id, WsTpClose, nil); err != nil {
+		return err
 	}
-	// fixme lock or NextWriter
-	if err := wsjson.Write(context.TODO(), h.WsConn, &finish); err != nil {
+	return nil
+}
+
+// tell the client the connection can not be established, with the reason in the close message.
+// Clients older than this message just ignore the body of close message.
+func (h *Hub) tellEstError(id ksuid.KSUID, estErr *ProxyEstError) error {
+	if err := h.WriteMessage(context.TODO(), id, WsTpClose, estErr); err != nil {
 		return err
 	}
 	return nil
@@ -4,13 +4,15 @@ import (
 	"github.com/segmentio/ksuid"
 	"nhooyr.io/websocket"
 	"sync"
+	"time"
 )
 
 // HubCollection is a set of hubs. It handle several hubs.
 // Each hub can map to a websocket connection,
 // which also handle several proxies instance.
 type HubCollection struct {
-	hubs map[ksuid.KSUID]*Hub
+	hubs     map[ksuid.KSUID]*Hub
+	sessions map[string]*Hub // hubs with resumable session, indexed by session id
 
 	mutex sync.RWMutex
 }
@@ -18,6 +20,7 @@ type HubCollection struct {
 func NewHubCollection() *HubCollection {
 	hc := HubCollection{}
 	hc.hubs = make(map[ksuid.KSUID]*Hub)
+	hc.sessions = make(map[string]*Hub)
 	return &hc
 }
 
@@ -36,6 +39,24 @@ func (hc *HubCollection) NewHub(conn *websocket.Conn) *Hub {
 	return &hub
 }
 
+// Generation returns the attaching generation of hub, it increases each time the hub is reattached.
+func (hc *HubCollection) Generation(hub *Hub) int {
+	hc.mutex.RLock()
+	defer hc.mutex.RUnlock()
+	return hub.gen
+}
+
+// CompressionStats returns the statistics of data compression on all hubs.
+func (hc *HubCollection) CompressionStats() CompressionStats {
+	hc.mutex.RLock()
+	defer hc.mutex.RUnlock()
+	var stats CompressionStats
+	for _, hub := range hc.hubs {
+		stats = stats.Add(hub.CompressionStats())
+	}
+	return stats
+}
+
 // count the client size and proxy connection size.
 func (hc *HubCollection) GetConnCount() (int, int) {
 	hc.mutex.Lock()
@@ -53,7 +74,73 @@ func (hc *HubCollection) GetConnCount() (int, int) {
 func (hc *HubCollection) RemoveProxy(id ksuid.KSUID) {
 	hc.mutex.Lock()
 	defer hc.mutex.Unlock()
-	if _, ok := hc.hubs[id]; ok {
+	if hub, ok := hc.hubs[id]; ok {
+		if hub.session != nil {
+			delete(hc.sessions, hub.session.id)
+		}
 		delete(hc.hubs, id)
 	}
 }
+
+// OnDisconnected is called when the websocket connection of hub is lost.
+// If the hub has a resumable session, it is kept for grace duration waiting for the client to resume it,
+// otherwise (or the session is not resumed in time), the hub is closed and removed.
+// gen is the attaching generation of the lost connection (see Generation),
+// if the hub has been reattached to a newer connection, nothing is done.
+func (hc *HubCollection) OnDisconnected(hub *Hub, gen int, grace time.Duration) {
+	hc.mutex.Lock()
+	if hub.gen != gen {
+		hc.mutex.Unlock()
+		return
+	}
+	if hub.session != nil && grace > 0 {
+		hub.detachTimer = time.AfterFunc(grace, func() {
+			hc.mutex.Lock()
+			if hub.gen != gen {
+				hc.mutex.Unlock()
+				return // reattached
+			}
+			hub.detachTimer = nil
+			hc.mutex.Unlock()
+			hc.RemoveProxy(hub.id)
+			hub.Close()
+		})
+		hc.mutex.Unlock()
+		return
+	}
+	hc.mutex.Unlock()
+	hc.RemoveProxy(hub.id)
+	hub.Close()
+}
+
+// add a hub with resumable session, thus it can be found by its session id.
+func (hc *HubCollection) addSession(hub *Hub) {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	hc.sessions[hub.session.id] = hub
+}
+
+// attach finds the hub of a resumable session, and prepares it for reattaching to a new websocket connection.
+// The old websocket connection of hub is closed, and it waits the reading on the old connection to finish.
+// It returns nil if the session is not found or expired.
+func (hc *HubCollection) attach(sessionId string) *Hub {
+	hc.mutex.Lock()
+	hub, ok := hc.sessions[sessionId]
+	if !ok {
+		hc.mutex.Unlock()
+		return nil
+	}
+	if hub.detachTimer != nil {
+		if !hub.detachTimer.Stop() {
+			hc.mutex.Unlock()
+			return nil // the session is expired and being closed.
+		}
+		hub.detachTimer = nil
+	}
+	hub.gen++
+	hc.mutex.Unlock()
+
+	_ = hub.WSClose() // the old connection may be still alive if server does not notice the disconnection.
+	hub.readMu.Lock()
+	return hub
+}
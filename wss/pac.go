@@ -0,0 +1,125 @@
+package wss
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// path of the proxy auto-config (PAC) script on the http proxy listener.
+const PacPath = "/proxy.pac"
+
+// Pac generates proxy auto-config scripts, pointing to the socks5 and http proxy of client.
+// See https://developer.mozilla.org/en-US/docs/Web/HTTP/Proxy_servers_and_tunneling/Proxy_Auto-Configuration_PAC_file.
+type Pac struct {
+	socks5Addr string       // listen address of socks5 (and https) proxy
+	httpAddr   string       // listen address of http proxy
+	domains    []string     // domains connected directly, including their subdomains
+	networks   []*net.IPNet // ipv4 networks connected directly
+}
+
+// NewPac creates a Pac with the listen addresses of socks5 and http proxy, and direct-connect exceptions.
+// An exception is a domain (e.g. "example.com" or "*.example.com", for the domain and all its subdomains),
+// or an ipv4 CIDR (e.g. "10.0.0.0/8"). Loopback addresses are always connected directly.
+func NewPac(socks5Addr, httpAddr string, direct []string) (*Pac, error) {
+	p := Pac{socks5Addr: socks5Addr, httpAddr: httpAddr, domains: []string{}}
+	for _, d := range direct {
+		if strings.Contains(d, "/") {
+			ip, network, err := net.ParseCIDR(d)
+			if err != nil {
+				return nil, err
+			}
+			if ip.To4() == nil {
+				return nil, fmt.Errorf("direct network %s of pac: only ipv4 is supported", d)
+			}
+			p.networks = append(p.networks, network)
+			continue
+		}
+		domain := strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(d, "*"), "."))
+		if domain == "" || !validHost(domain) {
+			return nil, fmt.Errorf("bad direct domain %q of pac", d)
+		}
+		p.domains = append(p.domains, domain)
+	}
+	return &p, nil
+}
+
+// Script generates the PAC script for the request fetching it.
+// If a listen address has no specified host, the host in the request is used,
+// which is the address of client reachable by the browser.
+func (p *Pac) Script(req *http.Request) string {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	socks5Addr, httpAddr := pacAddr(p.socks5Addr, host), pacAddr(p.httpAddr, host)
+
+	domains, _ := json.Marshal(p.domains)
+	var networks []string
+	for _, n := range p.networks {
+		networks = append(networks, fmt.Sprintf(`[%q, %q]`, n.IP.String(), net.IP(n.Mask).String()))
+	}
+	return fmt.Sprintf(`// proxy auto-config generated by wssocks client.
+var directDomains = %s;
+var directNetworks = [%s];
+
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	if (host == "localhost" || shExpMatch(host, "127.*") || host == "::1" || host == "[::1]") {
+		return "DIRECT";
+	}
+	for (var i = 0; i < directDomains.length; i++) {
+		if (host == directDomains[i] || dnsDomainIs(host, "." + directDomains[i])) {
+			return "DIRECT";
+		}
+	}
+	// only ip addresses are checked, not to resolve the host name locally.
+	if (/^\d+\.\d+\.\d+\.\d+$/.test(host)) {
+		for (var i = 0; i < directNetworks.length; i++) {
+			if (isInNet(host, directNetworks[i][0], directNetworks[i][1])) {
+				return "DIRECT";
+			}
+		}
+	}
+	// https (CONNECT) is served by the socks5 listener, and plain http by the http listener.
+	if (url.substring(0, 5) == "http:") {
+		return "SOCKS5 %[3]s; SOCKS %[3]s; PROXY %[4]s";
+	}
+	return "SOCKS5 %[3]s; SOCKS %[3]s; PROXY %[3]s";
+}
+`, domains, strings.Join(networks, ", "), socks5Addr, httpAddr)
+}
+
+// the address of a listener in PAC script, host is used if the listen address has no specified host.
+func pacAddr(listen, host string) string {
+	h, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	if ip := net.ParseIP(h); h == "" || ip != nil && ip.IsUnspecified() {
+		h = host
+	}
+	return net.JoinHostPort(h, port)
+}
+
+// write the PAC script as the response to req.
+func (p *Pac) writeResponse(w io.Writer, req *http.Request, keepAlive bool) error {
+	script := p.Script(req)
+	connection := "keep-alive"
+	if !keepAlive {
+		connection = "close"
+	}
+	body := script
+	if req.Method == http.MethodHead {
+		body = ""
+	}
+	_, err := fmt.Fprintf(w, "HTTP/1.1 200 OK\r\nContent-Type: application/x-ns-proxy-autoconfig\r\nContent-Length: %d\r\nConnection: %s\r\n\r\n%s",
+		len(script), connection, body)
+	return err
+}
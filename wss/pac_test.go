@@ -0,0 +1,26 @@
+package wss
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPac(t *testing.T) {
+	for _, bad := range []string{"fd00::/8", "10.0.0.0/33", "*.", "bad domain"} {
+		if _, err := NewPac(":1080", ":1086", []string{bad}); err == nil {
+			t.Errorf("direct exception %q is accepted", bad)
+		}
+	}
+
+	p, err := NewPac(":1080", "127.0.0.1:1086", []string{"*.Example.com", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := p.Script(&http.Request{Host: "192.168.1.5:1086"})
+	for _, want := range []string{`["example.com"]`, `["10.0.0.0", "255.0.0.0"]`, `"SOCKS5 192.168.1.5:1080; SOCKS 192.168.1.5:1080; PROXY 127.0.0.1:1086"`} {
+		if !strings.Contains(script, want) {
+			t.Errorf("%s is not in pac script:\n%s", want, script)
+		}
+	}
+}
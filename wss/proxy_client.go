@@ -7,7 +7,6 @@ import (
 
 	"github.com/segmentio/ksuid"
 	log "github.com/sirupsen/logrus"
-	"nhooyr.io/websocket/wsjson"
 )
 
 const (
@@ -23,6 +22,7 @@ type ProxyClient struct {
 	onData   func(ksuid.KSUID, ServerData) // data from server todo data with  type
 	onClosed func(ksuid.KSUID, bool)       // close connection, param bool: do tellClose if true
 	onError  func(ksuid.KSUID, error)      // if there are error messages
+	window   *sendWindow                   // send window for flow control (nil if disabled)
 }
 
 type ServerData struct {
@@ -45,11 +45,7 @@ func (p *ProxyClient) Establish(wsc *WebSocketClient, firstSendData []byte, prox
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
-	if err := wsjson.Write(ctx, wsc.WsConn, &WebSocketMessage{
-		Type: WsTpEst,
-		Id:   p.Id.String(),
-		Data: estMsg,
-	}); err != nil {
+	if err := wsc.WriteMessage(ctx, p.Id, WsTpEst, estMsg); err != nil {
 		log.Error("json error:", err)
 		return err
 	}
@@ -0,0 +1,210 @@
+package wss
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// static port forwarding (like ssh -L):
+// each connection accepted on a local address is proxied to a fixed target via wssocks server,
+// without any handshake of proxy protocol.
+// For udp forwarding, each peer of the local udp socket has its own udp association on server
+// (as socks5 UDP ASSOCIATE), which is closed after it is expired on server.
+
+// size of the queue of datagrams from a udp peer, the datagrams are dropped if it is full.
+const udpForwardQueueSize = 64
+
+// ListenAndServeForward listens on local address, and forwards the connections to target via wssocks server.
+// For each proxy connection, the websocket connection to wssocks server is picked by picker.
+func (client *Client) ListenAndServeForward(record *ConnRecord, picker WebSocketClientPicker, address, target string, onConnected func()) error {
+	if err := checkForwardTarget(target); err != nil {
+		return err
+	}
+	netListener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	tcpl, ok := (netListener).(*net.TCPListener)
+	if !ok {
+		netListener.Close()
+		return errors.New("not a tcp listener")
+	}
+	client.tcpl = tcpl
+
+	onConnected()
+	return client.serveTunnels(record, picker, ProxyTypeForward, func(conn *net.TCPConn) (string, error) {
+		return target, nil
+	})
+}
+
+// ListenAndServeUdpForward listens on local udp address, and forwards the datagrams to target via wssocks server.
+// The datagrams from target are sent back to the peer which the association belongs to.
+func (client *Client) ListenAndServeUdpForward(record *ConnRecord, picker WebSocketClientPicker, address, target string, onConnected func()) error {
+	if err := checkForwardTarget(target); err != nil {
+		return err
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	relay, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+	client.udpl = relay
+
+	onConnected()
+	header := appendForwardTarget(nil, target)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var mu sync.Mutex
+	peers := make(map[string]chan []byte) // queued datagrams of each peer
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, from, err := relay.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-client.stop:
+				return StoppedError
+			default:
+			}
+			return fmt.Errorf("udp read error: %w", err)
+		}
+		datagram := append(append(make([]byte, 0, len(header)+n), header...), buffer[:n]...)
+
+		mu.Lock()
+		queue, ok := peers[from.String()]
+		if !ok {
+			queue = make(chan []byte, udpForwardQueueSize)
+			peers[from.String()] = queue
+			go func(from *net.UDPAddr) {
+				if err := client.forwardDatagrams(ctx, record, picker, relay, from, target, queue); err != nil {
+					log.Error("udp forward error: ", err)
+				}
+				mu.Lock()
+				delete(peers, from.String())
+				mu.Unlock()
+			}(from)
+		}
+		mu.Unlock()
+		select {
+		case queue <- datagram:
+		default: // the association is too slow, drop the datagram
+		}
+	}
+}
+
+// relay the queued datagrams of peer from to target by a udp association on server,
+// until the association is closed, or ctx is done.
+func (client *Client) forwardDatagrams(ctx context.Context, record *ConnRecord, picker WebSocketClientPicker,
+	relay *net.UDPConn, from *net.UDPAddr, target string, queue chan []byte) error {
+	wsc, err := picker.Pick()
+	if err != nil {
+		return err
+	}
+	if !wsc.HasFeature(FeatureUdpAssociate) {
+		return errors.New("udp forwarding is not supported by server")
+	}
+	client.wgClose.Add(1)
+	defer client.wgClose.Done()
+	record.Update(ConnStatus{IsNew: true, Address: target, Type: ProxyTypeSocks5Udp})
+	defer record.Update(ConnStatus{IsNew: false, Address: target, Type: ProxyTypeSocks5Udp})
+
+	type Done struct {
+		tell bool
+		err  error
+	}
+	done := make(chan Done, 4)
+	finish := func(d Done) {
+		select {
+		case done <- d:
+		default:
+		}
+	}
+	established := make(chan struct{}, 1)
+
+	proxy := wsc.NewProxy(func(id ksuid.KSUID, data ServerData) {
+		switch data.Tag {
+		case TagEstOk:
+			established <- struct{}{}
+			return
+		case TagEstErr:
+			finish(Done{tell: false, err: errors.New("server failed to create udp association")})
+			return
+		}
+		// the datagram from server is prefixed by its source address.
+		if _, _, payload, err := parseSocks5Addr(data.Data); err == nil {
+			_, _ = relay.WriteToUDP(payload, from)
+		}
+	}, func(id ksuid.KSUID, tell bool) {
+		finish(Done{tell: tell})
+	}, func(id ksuid.KSUID, err error) {
+		finish(Done{tell: !errors.As(err, new(*ProxyEstError)), err: err})
+	})
+
+	if err := proxy.Establish(wsc, nil, ProxyTypeSocks5Udp, target); err != nil {
+		wsc.RemoveProxy(proxy.Id)
+		return err
+	}
+	select {
+	case <-established:
+	case d := <-done:
+		wsc.RemoveProxy(proxy.Id)
+		return d.err
+	case <-ctx.Done():
+		wsc.RemoveProxy(proxy.Id)
+		return wsc.TellClose(proxy.Id)
+	}
+	log.WithField("peer", from.String()).WithField("target", target).Debug("udp forwarding association is created.")
+
+	d := Done{tell: true}
+loop:
+	for {
+		select {
+		case datagram := <-queue:
+			if err := wsc.WriteDatagram(ctx, proxy.Id, datagram); err != nil {
+				d = Done{tell: true, err: err}
+				break loop
+			}
+		case d = <-done:
+			break loop
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	wsc.RemoveProxy(proxy.Id)
+	if d.tell {
+		if err := wsc.TellClose(proxy.Id); err != nil {
+			return err
+		}
+	}
+	return d.err
+}
+
+// the target of port forwarding must be host:port, which can not be misinterpreted on server.
+func checkForwardTarget(target string) error {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || !validHost(host) || !validPort(port) || port == "0" {
+		return fmt.Errorf("bad forwarding target %q", target)
+	}
+	return nil
+}
+
+// append the socks5 address of target (host:port, checked by checkForwardTarget) to b.
+func appendForwardTarget(b []byte, target string) []byte {
+	host, portStr, _ := net.SplitHostPort(target)
+	port, _ := strconv.Atoi(portStr)
+	if ip := net.ParseIP(host); ip != nil {
+		return appendSocks5Addr(b, ip, port)
+	}
+	b = append(append(b, socks5AddrDomain, byte(len(host))), host...)
+	return append(b, byte(port>>8), byte(port))
+}
@@ -1,64 +1,198 @@
 package wss
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/segmentio/ksuid"
 	log "github.com/sirupsen/logrus"
 )
 
 type HttpClient struct {
-	wsc    *WebSocketClient
-	record *ConnRecord
+	picker      WebSocketClientPicker
+	record      *ConnRecord
+	credentials Credentials // accepted Basic credentials, empty for no authentication
+	via         bool        // add Via header to the forwarded requests
+	forwarded   bool        // add X-Forwarded-For header to the forwarded requests
+	pac         *Pac        // served at PacPath, nil for disabling it
 }
 
-func NewHttpProxy(wsc *WebSocketClient, cr *ConnRecord) HttpClient {
-	return HttpClient{wsc: wsc, record: cr}
+func NewHttpProxy(picker WebSocketClientPicker, cr *ConnRecord) HttpClient {
+	return HttpClient{picker: picker, record: cr}
 }
 
+// SetCredentials requires http proxy clients to authenticate with one of the credentials.
+func (client *HttpClient) SetCredentials(credentials Credentials) {
+	client.credentials = credentials
+}
+
+// SetPac serves the proxy auto-config script of pac at PacPath.
+func (client *HttpClient) SetPac(pac *Pac) {
+	client.pac = pac
+}
+
+// SetForwardHeaders sets whether Via and X-Forwarded-For headers are added to the forwarded requests.
+func (client *HttpClient) SetForwardHeaders(via, forwardedFor bool) {
+	client.via = via
+	client.forwarded = forwardedFor
+}
+
+// time to wait for the next request on a kept-alive client connection.
+const httpIdleTimeout = 90 * time.Second
+
 func (client *HttpClient) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	conn, jack, err := hj.Hijack()
+	if err != nil {
+		log.Error("hijack error: ", err)
+		return
+	}
+	defer conn.Close()
+	req.Body = hijackedBody(req, jack.Reader)
+	// the case of header names in the first request is lost by http server.
+	client.serveConn(conn, jack, req)
+}
+
+// Serve accepts the connections of http proxy clients on l, and serves the requests on them.
+// It returns after l is closed.
+func (client *HttpClient) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			client.serveConn(conn, bufio.NewReadWriter(bufio.NewReaderSize(conn, maxHeaderSize), bufio.NewWriter(conn)), nil)
+		}()
+	}
+}
+
+// serve the requests on conn one by one, until it can not be kept alive.
+// The first request is req if it is already read, or nil.
+func (client *HttpClient) serveConn(conn net.Conn, rw *bufio.ReadWriter, req *http.Request) {
+	var names []string // header names of req in the original order and case
+	for {
+		if req == nil {
+			var err error
+			_ = conn.SetReadDeadline(time.Now().Add(httpIdleTimeout))
+			if req, names, err = readRequest(rw.Reader); err != nil {
+				return // connection closed by client, or idle timeout
+			}
+			_ = conn.SetReadDeadline(time.Time{})
+			req.RemoteAddr = conn.RemoteAddr().String()
+		}
+		keepAlive := client.serveRequest(rw, req, names)
+		if err := rw.Flush(); err != nil || !keepAlive {
+			return
+		}
+		req, names = nil, nil
+	}
+}
+
+// send req to server by a new proxy, and write the response to rw.
+// If it is an upgrade request, the rest data of rw is also sent, for the upgraded connection.
+// It returns true if the connection can be used for the next request.
+func (client *HttpClient) serveRequest(rw *bufio.ReadWriter, req *http.Request, names []string) bool {
+	jack := rw.Writer
 	type Done struct {
 		tell bool
 		err  error
 	}
-	done := make(chan Done, 2)
+	done := make(chan Done, 3)
 	continued := make(chan int)
 	defer close(continued)
 	//defer close(done)
 
-	hj, _ := w.(http.Hijacker)
-	conn, jack, _ := hj.Hijack()
-	defer conn.Close()
-	defer jack.Flush()
+	// establish with header fixme record
+	if !req.URL.IsAbs() {
+		if client.pac != nil && req.URL.Path == PacPath && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+			keepAlive := httpKeepAlive(req)
+			if _, err := io.Copy(ioutil.Discard, req.Body); err != nil {
+				return false
+			}
+			return client.pac.writeResponse(jack, req, keepAlive) == nil && keepAlive
+		}
+		_ = writeHttpError(jack, http.StatusForbidden, "This is a proxy server. Does not respond to non-proxy requests.")
+		return false
+	}
+	if !client.credentials.verifyProxyAuthorization(req) {
+		_ = writeHttpAuthRequired(jack)
+		return false
+	}
+
+	wsc, err := client.picker.Pick()
+	if err != nil {
+		_ = writeHttpError(jack, http.StatusBadGateway, "No available connection to wssocks server.")
+		return false
+	}
+	upgrade := isUpgradeRequest(req.Header) && wsc.HasFeature(FeatureHttpUpgrade)
+	// response is delimited by server, if it is supported.
+	keepAlive := !upgrade && httpKeepAlive(req) && wsc.HasFeature(FeatureHttpKeepAlive)
 
-	proxy := client.wsc.NewProxy(nil, nil, nil)
+	proxy := wsc.NewProxy(nil, nil, nil)
+	// buffer of response data from server, if flow control is enabled.
+	receiver := wsc.newFlowReceiver(proxy.Id)
 	proxy.onData = func(id ksuid.KSUID, data ServerData) {
 		if data.Tag == TagEstOk || data.Tag == TagEstErr {
 			continued <- data.Tag
 			return
 		}
+		if receiver != nil {
+			if _, err := receiver.Write(data.Data); err != nil {
+				select {
+				case done <- Done{true, err}: // reset the stream
+				default: // never block the websocket reading
+				}
+			}
+			return
+		}
 		if _, err := jack.Write(data.Data); err != nil {
 			done <- Done{true, err}
+			return
+		}
+		if err := jack.Flush(); err != nil { // e.g. streaming response or upgraded connection
+			done <- Done{true, err}
 		}
 	}
 	proxy.onClosed = func(id ksuid.KSUID, tell bool) {
+		if receiver != nil {
+			_ = receiver.Close() // finish after all buffered data is written.
+			return
+		}
 		done <- Done{tell, nil}
 	}
 	proxy.onError = func(ksuids ksuid.KSUID, err error) {
+		var estErr *ProxyEstError
+		if errors.As(err, &estErr) {
+			// the request can not be sent by server, response the reason.
+			_ = writeHttpEstError(jack, estErr)
+			done <- Done{false, err}
+			return
+		}
 		done <- Done{true, err}
 	}
 
-	// establish with header fixme record
-	if !req.URL.IsAbs() {
-		client.wsc.RemoveProxy(proxy.Id)
-		w.WriteHeader(403)
-		_, _ = w.Write([]byte("This is a proxy server. Does not respond to non-proxy requests."))
-		return
+	if receiver != nil {
+		defer receiver.Close()
+		go func() {
+			err := receiver.copyTo(jack)
+			done <- Done{err != nil, err}
+		}()
 	}
 
 	client.record.Update(ConnStatus{IsNew: true, Address: req.URL.Host, Type: ProxyTypeHttp})
@@ -66,56 +200,101 @@ func (client *HttpClient) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	var headerBuffer bytes.Buffer
 	host, _ := client.parseUrl(req.Method, req.Proto, req.URL)
-	HttpRequestHeader(&headerBuffer, req)
+	writeRequestHeader(&headerBuffer, req, client.forwardHeader(req, keepAlive, upgrade), names)
 
-	if err := proxy.Establish(client.wsc, headerBuffer.Bytes(), ProxyTypeHttp, host); err != nil { // fixme default port
+	if err := proxy.Establish(wsc, headerBuffer.Bytes(), ProxyTypeHttp, host); err != nil { // fixme default port
 		log.Error("write header error:", err)
-		client.wsc.RemoveProxy(proxy.Id)
-		if err := client.wsc.TellClose(proxy.Id); err != nil {
+		wsc.RemoveProxy(proxy.Id)
+		if err := wsc.TellClose(proxy.Id); err != nil {
 			log.Error("close error", err)
 		}
-		return
+		return false
 	}
 
 	// fixme add timeout
 	// wait receiving "established connection" from server
-	if tag := <-continued; tag == TagEstErr {
-		return
+	select {
+	case tag := <-continued:
+		if tag == TagEstErr {
+			return false
+		}
+	case d := <-done: // the connection is refused by server before establishing.
+		wsc.RemoveProxy(proxy.Id)
+		if d.err != nil {
+			log.Error(d.err)
+		}
+		return false
 	}
 
 	// copy request body data
-	writer := NewWebSocketWriter(&client.wsc.ConcurrentWebSocket, proxy.Id, context.Background())
+	writer := NewWebSocketWriter(&wsc.ConcurrentWebSocket, proxy.Id, context.Background()).WithWindow(proxy.window)
 	if _, err := io.Copy(writer, req.Body); err != nil {
 		log.Error("write body error:", err)
-		client.wsc.RemoveProxy(proxy.Id)
-		if err := client.wsc.TellClose(proxy.Id); err != nil {
+		wsc.RemoveProxy(proxy.Id)
+		if err := wsc.TellClose(proxy.Id); err != nil {
 			log.Error("close error", err)
 		}
-		return
+		return false
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	if err := client.wsc.WriteProxyMessage(ctx, proxy.Id, TagNoMore, nil); err != nil {
+	if upgrade {
+		// relay the data of proxy client application, which is for the upgraded connection (if it is upgraded),
+		// until the application closes its connection.
+		go func() {
+			if _, err := io.Copy(writer, rw.Reader); err == nil {
+				_ = wsc.WriteProxyMessage(ctx, proxy.Id, TagNoMore, nil)
+			}
+		}()
+	} else if err := wsc.WriteProxyMessage(ctx, proxy.Id, TagNoMore, nil); err != nil {
 		log.Error("write body error:", err)
-		client.wsc.RemoveProxy(proxy.Id)
-		if err := client.wsc.TellClose(proxy.Id); err != nil {
+		wsc.RemoveProxy(proxy.Id)
+		if err := wsc.TellClose(proxy.Id); err != nil {
 			log.Error("close error", err)
 		}
-		return
+		return false
 	}
 
 	// finished
 	d := <-done // fixme add timeout
-	client.wsc.RemoveProxy(proxy.Id)
+	wsc.RemoveProxy(proxy.Id)
 	if d.tell {
-		if err := client.wsc.TellClose(proxy.Id); err != nil {
+		if err := wsc.TellClose(proxy.Id); err != nil {
 			log.Error(err)
 		}
 	}
 	if d.err != nil {
 		log.Error(d.err)
+		return false
+	}
+	return keepAlive
+}
+
+// header of req to be forwarded, without hop-by-hop headers (except the upgrading ones for an upgrade request).
+func (client *HttpClient) forwardHeader(req *http.Request, keepAlive, upgrade bool) http.Header {
+	header := req.Header.Clone()
+	if upgrade {
+		keepUpgradeHeaders(header, req.Header.Get("Upgrade"))
+	} else {
+		removeHopHeaders(header)
+	}
+	if !keepAlive && !upgrade {
+		// server closes the proxy after the response, and it is not delimited by an older server.
+		header.Set("Connection", "close")
+	}
+	if client.via {
+		header.Add("Via", fmt.Sprintf("%d.%d wssocks", req.ProtoMajor, req.ProtoMinor))
+	}
+	if client.forwarded {
+		if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			if prior := header["X-Forwarded-For"]; len(prior) > 0 {
+				ip = strings.Join(prior, ", ") + ", " + ip
+			}
+			header.Set("X-Forwarded-For", ip)
+		}
 	}
+	return header
 }
 
 func copyHeaders(dst, src http.Header) {
@@ -0,0 +1,71 @@
+package wss
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// methods of the plain http proxy requests detected on the socks5 listener.
+var plainHttpMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS", "PATCH", "TRACE"}
+
+// HttpPlainClient detects the plain http proxy requests (with absolute-form request target) on the socks5 listener,
+// and the connection is then served by HttpClient, as the connections on http listener.
+type HttpPlainClient struct {
+	requestLine []byte // request line of the first request, which is consumed in parsing
+}
+
+func (client *HttpPlainClient) ProxyType() int {
+	return ProxyTypeHttp
+}
+
+// data may be only a part of the request line, so it only needs to be a prefix of "METHOD " (or vice versa).
+func (client *HttpPlainClient) Trigger(data []byte) bool {
+	for _, method := range plainHttpMethods {
+		prefix := method + " "
+		n := len(data)
+		if n > len(prefix) {
+			n = len(prefix)
+		}
+		if string(data[:n]) == prefix[:n] {
+			return true
+		}
+	}
+	return false
+}
+
+// the request line is read from reader, and the target of the first request is returned.
+func (client *HttpPlainClient) ParseHeader(conn net.Conn, reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return "", err
+	}
+	client.requestLine = line
+	fields := strings.Fields(string(line))
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "HTTP/") {
+		return "", fmt.Errorf("bad http request line %q", line)
+	}
+	u, err := url.ParseRequestURI(fields[1])
+	if err != nil {
+		return "", err
+	}
+	if !u.IsAbs() || u.Hostname() == "" {
+		_ = writeHttpError(conn, http.StatusForbidden, "This is a proxy server. Does not respond to non-proxy requests.")
+		return "", errors.New("not a proxy request")
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// origin is the data following the request line, and the data received so far is returned,
+// which is read again by HttpClient.
+func (client *HttpPlainClient) EstablishData(origin []byte) ([]byte, error) {
+	return append(client.requestLine, origin...), nil
+}
@@ -2,53 +2,55 @@ package wss
 
 import (
 	"bufio"
-	"bytes"
-	"fmt"
+	"errors"
 	"net"
-	"net/url"
+	"net/http"
 )
 
+const connectMethod = "CONNECT"
+
 type HttpsClient struct {
+	credentials Credentials // accepted Basic credentials, empty for no authentication
 }
 
 func (client *HttpsClient) ProxyType() int {
 	return ProxyTypeHttps
 }
 
+// data may be only a part of the request line, so it only needs to be a prefix of "CONNECT " (or vice versa).
 func (client *HttpsClient) Trigger(data []byte) bool {
-	return len(data) > len("CONNECT") && string(data[:len("CONNECT")]) == "CONNECT"
+	prefix := connectMethod + " "
+	n := len(data)
+	if n > len(prefix) {
+		n = len(prefix)
+	}
+	return n > 0 && string(data[:n]) == prefix[:n]
 }
 
 func (client *HttpsClient) EstablishData(origin []byte) ([]byte, error) {
-	return nil, nil
+	return origin, nil
 }
 
 // parsing https header, and return address and parsing error
-func (client *HttpsClient) ParseHeader(conn net.Conn, header []byte) (string, error) {
-	buff := bytes.NewBuffer(header)
-	if line, _, err := bufio.NewReader(buff).ReadLine(); err != nil {
+func (client *HttpsClient) ParseHeader(conn net.Conn, reader *bufio.Reader) (string, error) {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
 		return "", err
-	} else {
-		var method, address, httpVer string
-		if _, err := fmt.Sscanf(string(line), "%s %s %s", &method, &address, &httpVer); err != nil {
-			return "", err
-		} else {
-			if u, err := url.Parse(address); err != nil {
-				return "", err
-			} else {
-				var host string
-				// parsing port and host
-				if u.Opaque == "443" { // https
-					host = u.Scheme + ":443"
-				} else { // https
-					if u.Port() == "" {
-						host = net.JoinHostPort(u.Host, "443")
-					} else {
-						host = net.JoinHostPort(u.Host, u.Port())
-					}
-				}
-				return host, nil
-			}
-		}
 	}
+	if req.Method != connectMethod {
+		return "", errors.New("not a CONNECT request")
+	}
+	if !client.credentials.verifyProxyAuthorization(req) {
+		_ = writeHttpAuthRequired(conn)
+		return "", errors.New("http proxy authentication failed")
+	}
+	// the request target of CONNECT is in authority form (host:port), see rfc 7231, section 4.3.6.
+	host, port := req.URL.Hostname(), req.URL.Port()
+	if host == "" {
+		return "", errors.New("empty host in CONNECT request")
+	}
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(host, port), nil
 }
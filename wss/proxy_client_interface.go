@@ -1,6 +1,7 @@
 package wss
 
 import (
+	"bufio"
 	"net"
 )
 
@@ -8,6 +9,13 @@ const (
 	ProxyTypeSocks5 = iota
 	ProxyTypeHttp
 	ProxyTypeHttps
+	ProxyTypeSocks5Udp        // socks5 UDP ASSOCIATE
+	ProxyTypeSocks5Bind       // socks5 BIND
+	ProxyTypeSocks4           // socks4 and socks4a
+	ProxyTypeSocks5Resolve    // tor socks5 RESOLVE
+	ProxyTypeSocks5ResolvePtr // tor socks5 RESOLVE_PTR
+	ProxyTypeTransparent      // connection redirected to the transparent proxy listener
+	ProxyTypeForward          // static port forwarding to a fixed target
 )
 
 func ProxyTypeStr(tp int) string {
@@ -18,6 +26,20 @@ func ProxyTypeStr(tp int) string {
 		return "https"
 	case ProxyTypeSocks5:
 		return "socks5"
+	case ProxyTypeSocks5Udp:
+		return "socks5-udp"
+	case ProxyTypeSocks5Bind:
+		return "socks5-bind"
+	case ProxyTypeSocks4:
+		return "socks4"
+	case ProxyTypeSocks5Resolve:
+		return "socks5-resolve"
+	case ProxyTypeSocks5ResolvePtr:
+		return "socks5-resolve-ptr"
+	case ProxyTypeTransparent:
+		return "transparent"
+	case ProxyTypeForward:
+		return "forward"
 	}
 	return "unknown"
 }
@@ -25,10 +47,13 @@ func ProxyTypeStr(tp int) string {
 // interface of proxy client, supported types: http/https/socks5
 type ProxyInterface interface {
 	ProxyType() int
-	// return a bool value to indicate whether it is the matched protocol.
+	// return a bool value to indicate whether it is the matched protocol,
+	// data is the bytes received so far (at least one byte), which may be only a part of the header.
 	Trigger(data []byte) bool
-	// parse protocol header bytes, return target host.
-	ParseHeader(conn net.Conn, header []byte) (string, error)
-	// return data transformed in connection establishing step.
+	// parse protocol header from reader, return target host.
+	// Replies of the protocol (e.g. authentication or errors) are written to conn.
+	ParseHeader(conn net.Conn, reader *bufio.Reader) (string, error)
+	// return data transformed in connection establishing step,
+	// origin is the bytes received after the header (can be nil).
 	EstablishData(origin []byte) ([]byte, error)
 }
@@ -0,0 +1,113 @@
+package wss
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// socks4 reply codes
+const (
+	socks4Granted  = 0x5A
+	socks4Rejected = 0x5B
+)
+
+// socks4 and socks4a proxy client.
+// see https://www.openssh.com/txt/socks4.protocol and https://www.openssh.com/txt/socks4a.protocol
+type Socks4Client struct {
+	// socks4 has no password, so it is rejected if socks5 authentication is required.
+	credentials Credentials
+	userId      string // user id in the request, available after parsing header
+}
+
+func (client *Socks4Client) ProxyType() int {
+	return ProxyTypeSocks4
+}
+
+func (client *Socks4Client) Trigger(data []byte) bool {
+	return len(data) >= 1 && data[0] == 0x04
+}
+
+func (client *Socks4Client) EstablishData(origin []byte) ([]byte, error) {
+	return origin, nil
+}
+
+// parsing socks4 header, and return address and parsing error
+func (client *Socks4Client) ParseHeader(conn net.Conn, reader *bufio.Reader) (string, error) {
+	/**
+	  +----+----+---------+--------+--------+------+------------+------+
+	  | VN | CD | DSTPORT | DSTIP  | USERID | NULL | (HOSTNAME) | NULL |
+	  +----+----+---------+--------+--------+------+------------+------+
+	  | 1  | 1  |    2    |   4    |  Var   |  1   |    Var     |  1   |
+	  +----+----+---------+--------+--------+------+------------+------+
+	  HOSTNAME is only presented in socks4a, where DSTIP is 0.0.0.x (x is non-zero).
+	*/
+	var head [8]byte
+	if _, err := io.ReadFull(reader, head[:]); err != nil {
+		return "", err
+	}
+	if head[0] != 0x04 {
+		return "", errors.New("not a socks4 request")
+	}
+	userId, err := readNullTerminated(reader)
+	if err != nil {
+		return "", err
+	}
+	client.userId = userId
+
+	if len(client.credentials) > 0 {
+		_ = writeSocks4Reply(conn, socks4Rejected)
+		return "", errors.New("socks4 is rejected, as socks5 authentication is required")
+	}
+	if head[1] != socks5CmdConnect { // only CONNECT is supported
+		_ = writeSocks4Reply(conn, socks4Rejected)
+		return "", errors.New("only CONNECT command of socks4 is supported")
+	}
+
+	port := binary.BigEndian.Uint16(head[2:4])
+	ip := net.IP(head[4:8])
+	host := ip.String()
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 { // socks4a
+		if host, err = readNullTerminated(reader); err != nil {
+			return "", err
+		}
+		if host == "" {
+			_ = writeSocks4Reply(conn, socks4Rejected)
+			return "", errors.New("empty host name in socks4a request")
+		}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+// max length of user id and host name in socks4 request.
+const socks4MaxFieldLength = 255
+
+// read a null-terminated string (at most socks4MaxFieldLength bytes) from reader.
+func readNullTerminated(reader *bufio.Reader) (string, error) {
+	var field []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		if b == 0x00 {
+			return string(field), nil
+		}
+		if len(field) == socks4MaxFieldLength {
+			return "", errors.New("too long field in socks4 request")
+		}
+		field = append(field, b)
+	}
+}
+
+// write socks4 reply, DSTPORT and DSTIP are ignored by clients.
+func writeSocks4Reply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{0x00, code, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	return err
+}
@@ -0,0 +1,24 @@
+package wss
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestSocks4ParseHeader(t *testing.T) {
+	var client Socks4Client
+	header := append([]byte{0x04, 0x01, 0x01, 0xBB, 0x00, 0x00, 0x00, 0x01}, "alice\x00example.com\x00"...)
+	if !client.Trigger(header[:1]) {
+		t.Fatal("socks4a request should be triggered")
+	}
+	addr, err := client.ParseHeader(nil, bufio.NewReader(bytes.NewReader(header)))
+	if err != nil || addr != "example.com:443" || client.userId != "alice" {
+		t.Errorf("unexpected socks4a request: %s %s %v", addr, client.userId, err)
+	}
+
+	addr, err = client.ParseHeader(nil, bufio.NewReader(bytes.NewReader([]byte{0x04, 0x01, 0x00, 0x50, 0x7F, 0x00, 0x00, 0x01, 0x00})))
+	if err != nil || addr != "127.0.0.1:80" || client.userId != "" {
+		t.Errorf("unexpected socks4 request: %s %s %v", addr, client.userId, err)
+	}
+}
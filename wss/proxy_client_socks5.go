@@ -1,35 +1,47 @@
 package wss
 
 import (
-	"bytes"
-	"encoding/binary"
+	"bufio"
 	"errors"
+	"fmt"
 	"io"
 	"net"
 	"strconv"
 )
 
 type Socks5Client struct {
+	credentials Credentials // accepted credentials, empty for no authentication
+	command     byte        // command in the request, available after parsing header
 }
 
 func (client *Socks5Client) ProxyType() int {
+	switch client.command {
+	case socks5CmdUdpAssociate:
+		return ProxyTypeSocks5Udp
+	case socks5CmdBind:
+		return ProxyTypeSocks5Bind
+	case socks5CmdResolve:
+		return ProxyTypeSocks5Resolve
+	case socks5CmdResolvePtr:
+		return ProxyTypeSocks5ResolvePtr
+	}
 	return ProxyTypeSocks5
 }
 
 func (client *Socks5Client) Trigger(data []byte) bool {
-	return len(data) >= 2 && data[0] == 0x05
+	return len(data) >= 1 && data[0] == 0x05
 }
 
 func (client *Socks5Client) EstablishData(origin []byte) ([]byte, error) {
-	return nil, nil
+	return origin, nil
 }
 
 // parsing socks5 header, and return address and parsing error
-func (client *Socks5Client) ParseHeader(conn net.Conn, header []byte) (string, error) {
+func (client *Socks5Client) ParseHeader(conn net.Conn, reader *bufio.Reader) (string, error) {
 	// response to socks5 client
 	// see rfc 1982 for more details (https://tools.ietf.org/html/rfc1928)
-	n, err := conn.Write([]byte{0x05, 0x00}) // version and no authentication required
-	if err != nil {
+	// step1: select authentication method (and authenticate)
+	if err := client.credentials.negotiate(conn, reader); err != nil {
 		return "", err
 	}
 
@@ -41,47 +53,27 @@ func (client *Socks5Client) ParseHeader(conn net.Conn, header []byte) (string, e
 	  | 1  |  1  | X'00' |  1   | Variable |    2     |
 	  +----+-----+-------+------+----------+----------+
 	*/
-	var buffer [1024]byte
-
-	n, err = conn.Read(buffer[:])
-	if err != nil {
+	var head [3]byte
+	if _, err := io.ReadFull(reader, head[:]); err != nil {
 		return "", err
 	}
-	if n < 6 {
-		return "", errors.New("not a socks protocol")
+	if head[0] != 0x05 {
+		return "", errors.New("not a socks5 request")
 	}
-
-	var host string
-	switch buffer[3] {
-	case 0x01:
-		// ipv4 address
-		ipv4 := make([]byte, 4)
-		if _, err := io.ReadAtLeast(bytes.NewReader(buffer[4:]), ipv4, len(ipv4)); err != nil {
-			return "", err
-		}
-		host = net.IP(ipv4).String()
-	case 0x04:
-		// ipv6
-		ipv6 := make([]byte, 16)
-		if _, err := io.ReadAtLeast(bytes.NewReader(buffer[4:]), ipv6, len(ipv6)); err != nil {
-			return "", err
-		}
-		host = net.IP(ipv6).String()
-	case 0x03:
-		// domain
-		addrLen := int(buffer[4])
-		domain := make([]byte, addrLen)
-		if _, err := io.ReadAtLeast(bytes.NewReader(buffer[5:]), domain, addrLen); err != nil {
-			return "", err
-		}
-		host = string(domain)
+	client.command = head[1]
+	switch client.command {
+	case socks5CmdConnect, socks5CmdBind, socks5CmdUdpAssociate, socks5CmdResolve, socks5CmdResolvePtr:
+	default:
+		_ = writeSocks5Reply(conn, 0x07, nil, 0) // command not supported
+		return "", fmt.Errorf("unsupported socks5 command %d", client.command)
 	}
 
-	port := make([]byte, 2)
-	err = binary.Read(bytes.NewReader(buffer[n-2:n]), binary.BigEndian, &port)
+	host, port, err := readSocks5Addr(reader)
+	if err == errBadSocks5Addr {
+		_ = writeSocks5Reply(conn, 0x08, nil, 0) // address type not supported
+	}
 	if err != nil {
 		return "", err
 	}
-
-	return net.JoinHostPort(host, strconv.Itoa((int(port[0])<<8)|int(port[1]))), nil
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
 }
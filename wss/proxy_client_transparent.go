@@ -0,0 +1,100 @@
+package wss
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// transparent proxy (linux only):
+// the connections redirected to the listener by iptables/nftables REDIRECT or TPROXY rules
+// are proxied to their original destinations, without any handshake of proxy protocol.
+// The original destination is recovered by SO_ORIGINAL_DST (REDIRECT),
+// or it is the local address of the connection (TPROXY).
+// Static port forwarding (ProxyTypeForward, see proxy_client_forward.go) is served in the same way, to a fixed target.
+// Unlike the proxy protocols, the application sends data without waiting for a reply,
+// so the data is not sent to server until server tells client (by TagEstOk) that the target is connected,
+// otherwise the data received by server before the proxy is established would be lost.
+
+var ErrTransparentNotSupported = errors.New("transparent proxy is only supported on linux")
+
+// ListenAndServeTransparent listens on local address for the redirected connections,
+// and forwards them to their original destinations via wssocks server.
+// For each proxy connection, the websocket connection to wssocks server is picked by picker.
+func (client *Client) ListenAndServeTransparent(record *ConnRecord, picker WebSocketClientPicker, address string, onConnected func()) error {
+	netListener, err := listenTransparent(address)
+	if err != nil {
+		return err
+	}
+	tcpl, ok := (netListener).(*net.TCPListener)
+	if !ok {
+		netListener.Close()
+		return errors.New("not a tcp listener")
+	}
+	client.tcpl = tcpl
+
+	onConnected()
+	listen := tcpl.Addr().(*net.TCPAddr)
+	return client.serveTunnels(record, picker, ProxyTypeTransparent, func(conn *net.TCPConn) (string, error) {
+		return transparentTarget(conn, listen)
+	})
+}
+
+// accept connections on client.tcpl, and proxy each of them to the address returned by target,
+// without any handshake of proxy protocol (proxyType is ProxyTypeTransparent or ProxyTypeForward).
+func (client *Client) serveTunnels(record *ConnRecord, picker WebSocketClientPicker, proxyType int, target func(conn *net.TCPConn) (string, error)) error {
+	for {
+		select {
+		case <-client.stop:
+			return StoppedError
+		default:
+		}
+
+		c, err := client.tcpl.Accept()
+		if err != nil {
+			return fmt.Errorf("tcp accept error: %w", err)
+		}
+		go func() {
+			conn := c.(*net.TCPConn)
+			defer conn.Close()
+			addr, err := target(conn)
+			if err != nil {
+				log.Error(ProxyTypeStr(proxyType), " proxy error: ", err)
+				return
+			}
+			wsc, err := picker.Pick()
+			if err != nil {
+				log.Error("no available connection to server: ", err)
+				return
+			}
+			if feature := proxyTypeFeatures[proxyType]; !wsc.HasFeature(feature) {
+				log.Error(ProxyTypeStr(proxyType), " proxy is not supported by server")
+				return
+			}
+			client.wgClose.Add(1)
+			defer client.wgClose.Done()
+
+			record.Update(ConnStatus{IsNew: true, Address: addr, Type: proxyType})
+			defer record.Update(ConnStatus{IsNew: false, Address: addr, Type: proxyType})
+
+			if err := client.transData(wsc, conn, nil, proxyType, addr); err != nil {
+				log.Error("trans error: ", err)
+			}
+		}()
+	}
+}
+
+// the original destination of a connection accepted by the transparent proxy listener.
+func transparentTarget(conn *net.TCPConn, listen *net.TCPAddr) (string, error) {
+	dst, err := originalDst(conn)
+	if err != nil {
+		return "", err
+	}
+	// the connection is made to the listener itself, proxying it would connect to the listener again.
+	if local, ok := conn.LocalAddr().(*net.TCPAddr); ok && dst.Port == listen.Port && dst.IP.Equal(local.IP) {
+		return "", fmt.Errorf("connection from %s is not redirected to the listener", conn.RemoteAddr())
+	}
+	return dst.String(), nil
+}
@@ -0,0 +1,113 @@
+package wss
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// error codes of establishing a proxy connection on server.
+const (
+	EstErrGeneral         = 1 // general failure
+	EstErrNotAllowed      = 2 // the proxy connection is not allowed by server
+	EstErrNetUnreachable  = 3 // network unreachable
+	EstErrHostUnreachable = 4 // host unreachable, including failure of resolving host name
+	EstErrConnRefused     = 5 // connection refused by the target
+	EstErrTimeout         = 6 // connecting to the target timeout
+	EstErrNotSupported    = 7 // the proxy type (or socks5 command) is not supported by server
+)
+
+// ProxyEstError is the reason of failing to establish a proxy connection on server.
+// It is sent to client as the body of the close message,
+// and client replies the matching socks5 reply code or http status to the proxy client application.
+type ProxyEstError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *ProxyEstError) Error() string {
+	return e.Message
+}
+
+// classify the error of dialing the target.
+func newProxyEstError(err error) *ProxyEstError {
+	estErr := ProxyEstError{Code: EstErrGeneral, Message: err.Error()}
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		estErr.Code = EstErrHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		estErr.Code = EstErrTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		estErr.Code = EstErrConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		estErr.Code = EstErrNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		estErr.Code = EstErrHostUnreachable
+	}
+	return &estErr
+}
+
+// the REP field of socks5 reply (see rfc 1928).
+func (e *ProxyEstError) socks5Rep() byte {
+	switch e.Code {
+	case EstErrNotAllowed:
+		return 0x02
+	case EstErrNetUnreachable:
+		return 0x03
+	case EstErrHostUnreachable, EstErrTimeout:
+		return 0x04
+	case EstErrConnRefused:
+		return 0x05
+	case EstErrNotSupported:
+		return 0x07
+	}
+	return 0x01 // general SOCKS server failure
+}
+
+func (e *ProxyEstError) httpStatus() int {
+	switch e.Code {
+	case EstErrNotAllowed:
+		return http.StatusForbidden
+	case EstErrTimeout:
+		return http.StatusGatewayTimeout
+	case EstErrNotSupported:
+		return http.StatusNotImplemented
+	}
+	return http.StatusBadGateway
+}
+
+// write the reply of the failure in the protocol of proxyType.
+func writeEstError(w io.Writer, proxyType int, e *ProxyEstError) error {
+	switch proxyType {
+	case ProxyTypeSocks5, ProxyTypeSocks5Bind, ProxyTypeSocks5Udp:
+		return writeSocks5EstError(w, e)
+	case ProxyTypeSocks4:
+		return writeSocks4Reply(w, socks4Rejected)
+	case ProxyTypeTransparent, ProxyTypeForward:
+		return nil // no protocol to reply the failure, the connection is just closed.
+	}
+	return writeHttpEstError(w, e)
+}
+
+// write socks5 reply of the failure.
+func writeSocks5EstError(w io.Writer, e *ProxyEstError) error {
+	return writeSocks5Reply(w, e.socks5Rep(), nil, 0)
+}
+
+// write http response of the failure.
+func writeHttpEstError(w io.Writer, e *ProxyEstError) error {
+	return writeHttpError(w, e.httpStatus(), "wssocks: failed to connect to the target: "+e.Message)
+}
+
+// write a plain text http response with status and message, and the connection is closed after it.
+func writeHttpError(w io.Writer, status int, message string) error {
+	body := message + "\n"
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		status, http.StatusText(status), len(body), body)
+	return err
+}
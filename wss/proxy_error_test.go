@@ -0,0 +1,35 @@
+package wss
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxyEstErrorRefused(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close() // nothing is listening on addr now.
+
+	_, err = net.DialTimeout("tcp", addr, time.Second)
+	if err == nil {
+		t.Skip("expect the connection refused")
+	}
+	estErr := newProxyEstError(err)
+	if estErr.Code != EstErrConnRefused || estErr.socks5Rep() != 0x05 {
+		t.Errorf("unexpected classification of %v: %+v", err, estErr)
+	}
+
+	var resp bytes.Buffer
+	if err := writeHttpEstError(&resp, estErr); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resp.String(), "HTTP/1.1 502 Bad Gateway\r\n") {
+		t.Errorf("unexpected http response: %q", resp.String())
+	}
+}
@@ -11,9 +11,12 @@ import (
 	"github.com/segmentio/ksuid"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httputil"
 	"nhooyr.io/websocket"
+	"strconv"
 	"time"
 )
 
@@ -38,41 +41,37 @@ type ClientData ServerData
 var ConnCloseByClient = errors.New("conn closed by client")
 
 func dispatchMessage(hub *Hub, msgType websocket.MessageType, data []byte, config WebsocksServerConfig) error {
-	if msgType == websocket.MessageText {
-		return dispatchDataMessage(hub, data, config)
-	}
-	return nil
-}
-
-func dispatchDataMessage(hub *Hub, data []byte, config WebsocksServerConfig) error {
-	var socketData json.RawMessage
-	socketStream := WebSocketMessage{
-		Data: &socketData,
-	}
-	if err := json.Unmarshal(data, &socketStream); err != nil {
+	frame, err := decodeFrame(msgType, data, hub.compression != nil)
+	if err != nil {
 		return err
 	}
-
-	// parsing id
-	id, err := ksuid.Parse(socketStream.Id)
-	if err != nil {
+	if err := hub.onFrameReceived(frame); err != nil {
 		return err
 	}
+	return dispatchFrame(hub, frame, config)
+}
 
-	switch socketStream.Type {
+func dispatchFrame(hub *Hub, frame *Frame, config WebsocksServerConfig) error {
+	id := frame.Id
+	switch frame.Type {
 	case WsTpBeats: // heart beats
 	case WsTpClose: // closed by client
 		return hub.CloseProxyConn(id)
 	case WsTpEst: // establish
 		var proxyEstMsg ProxyEstMessage
-		if err := json.Unmarshal(socketData, &proxyEstMsg); err != nil {
+		if err := json.Unmarshal(frame.Body, &proxyEstMsg); err != nil {
 			return err
 		}
 		// check proxy type support.
 		if (proxyEstMsg.Type == ProxyTypeHttp || proxyEstMsg.Type == ProxyTypeHttps) && !config.EnableHttp {
-			hub.tellClosed(id) // tell client to close connection.
+			// tell client to close connection.
+			hub.tellEstError(id, &ProxyEstError{Code: EstErrNotAllowed, Message: "http(s) proxy is not support in server side"})
 			return errors.New("http(s) proxy is not support in server side")
 		}
+		if proxyEstMsg.Type == ProxyTypeSocks5Bind && !config.EnableBind {
+			hub.tellEstError(id, &ProxyEstError{Code: EstErrNotAllowed, Message: "socks5 bind is not enabled in server side"})
+			return errors.New("socks5 bind is not enabled in server side")
+		}
 
 		var estData []byte = nil
 		if proxyEstMsg.WithData {
@@ -83,38 +82,50 @@ func dispatchDataMessage(hub *Hub, data []byte, config WebsocksServerConfig) err
 				estData = decodedBytes
 			}
 		}
-		go establishProxy(hub, ProxyRegister{id, proxyEstMsg.Type, proxyEstMsg.Addr, estData})
-	case WsTpData:
-		var requestMsg ProxyData
-		if err := json.Unmarshal(socketData, &requestMsg); err != nil {
-			return err
-		}
-
+		go establishProxy(hub, ProxyRegister{id, proxyEstMsg.Type, proxyEstMsg.Addr, estData}, config)
+	case WsTpData, WsTpDatagram:
 		if proxy := hub.GetProxyById(id); proxy != nil {
 			// write income data from websocket to TCP connection
-			if decodeBytes, err := base64.StdEncoding.DecodeString(requestMsg.DataBase64); err != nil {
-				log.Error("base64 decode error,", err)
-				return err
-			} else {
-				return proxy.ProxyIns.onData(ClientData{Tag: requestMsg.Tag, Data: decodeBytes})
-			}
+			return proxy.ProxyIns.onData(ClientData{Tag: frame.Tag, Data: frame.Data})
 		}
 		return nil
+	case WsTpResolve:
+		var req ResolveRequest
+		if err := json.Unmarshal(frame.Body, &req); err != nil {
+			return err
+		}
+		go hub.resolve(id, req)
+	case WsTpWindow:
+		var window ProxyWindow
+		if err := json.Unmarshal(frame.Body, &window); err != nil {
+			return err
+		}
+		if proxy := hub.GetProxyById(id); proxy != nil {
+			proxy.window.onUpdate(window.Consumed)
+		}
 	}
 	return nil
 }
 
-func establishProxy(hub *Hub, proxyMeta ProxyRegister) {
+func establishProxy(hub *Hub, proxyMeta ProxyRegister, config WebsocksServerConfig) {
 	var e ProxyEstablish
 	if proxyMeta._type == ProxyTypeHttp {
-		e = makeHttpProxyInstance()
+		e = makeHttpProxyInstance(hub, proxyMeta.id, config.HttpTransport)
+	} else if proxyMeta._type == ProxyTypeSocks5Udp {
+		e = newUdpProxyEst(config.UdpIdleTimeout)
+	} else if proxyMeta._type == ProxyTypeSocks5Bind {
+		e = &BindProxyEst{halfClose: hub.HasFeature(FeatureHalfClose)}
 	} else {
-		e = &DefaultProxyEst{}
+		e = &DefaultProxyEst{halfClose: hub.HasFeature(FeatureHalfClose), dialer: config.Dialer}
 	}
 
 	err := e.establish(hub, proxyMeta.id, proxyMeta._type, proxyMeta.addr, proxyMeta.withData)
+	var estErr *ProxyEstError
 	if err == nil {
 		hub.tellClosed(proxyMeta.id) // tell client to close connection.
+	} else if errors.As(err, &estErr) {
+		log.Error(err)
+		hub.tellEstError(proxyMeta.id, estErr) // tell client the reason of failure.
 	} else if err != ConnCloseByClient {
 		log.Error(err) // todo error handle better way
 		hub.tellClosed(proxyMeta.id)
@@ -127,83 +138,220 @@ func establishProxy(hub *Hub, proxyMeta ProxyRegister) {
 type ChanDone struct {
 	tell bool
 	err  error
+	half bool // only one direction is finished (half-close)
 }
 
 // interface implementation for socks5 and https proxy.
 type DefaultProxyEst struct {
-	done    chan ChanDone
-	tcpConn net.Conn
+	done      chan ChanDone
+	tcpConn   net.Conn
+	receiver  *flowReceiver // buffer of data from client, nil if flow control is disabled.
+	halfClose bool          // half-close is negotiated with client
+	drain     peerDrain
+	dialer    *net.Dialer // dialer to connect to the target
+}
+
+// send a finishing signal, it never blocks the websocket reading.
+func (e *DefaultProxyEst) finish(d ChanDone) {
+	select {
+	case e.done <- d:
+	default: // enough signals to finish the proxy
+	}
 }
 
 func (e *DefaultProxyEst) onData(data ClientData) error {
+	if e.halfClose && data.Tag == TagNoMore {
+		if e.receiver != nil {
+			return e.receiver.Close() // half-close tcpConn after the buffered data is written.
+		}
+		e.onDrained()
+		return nil
+	}
+	if e.receiver != nil {
+		// data is written to tcpConn in another goroutine
+		if _, err := e.receiver.Write(data.Data); err != nil {
+			e.finish(ChanDone{tell: true, err: err}) // reset the stream
+			return err
+		}
+		return nil
+	}
 	if _, err := e.tcpConn.Write(data.Data); err != nil {
-		e.done <- ChanDone{true, err}
+		e.finish(ChanDone{tell: true, err: err})
 	}
 	return nil
 }
 
+// called after all data from client is written to tcpConn.
+func (e *DefaultProxyEst) onDrained() {
+	if e.drain.onDrained() || !e.halfClose {
+		e.finish(ChanDone{tell: false, err: ConnCloseByClient})
+		return
+	}
+	// no more data from client.
+	if err := closeWrite(e.tcpConn); err != nil {
+		e.finish(ChanDone{tell: true, err: err})
+		return
+	}
+	e.finish(ChanDone{half: true})
+}
+
 func (e *DefaultProxyEst) Close(tell bool) error {
-	e.done <- ChanDone{tell, ConnCloseByClient}
+	if e.drain.onClosed() {
+		e.finish(ChanDone{tell: tell, err: ConnCloseByClient})
+		return nil
+	}
+	if e.receiver != nil {
+		// finish after the buffered data is written to tcpConn.
+		return e.receiver.Close()
+	}
+	e.finish(ChanDone{tell: tell, err: ConnCloseByClient})
 	return nil // todo error
 }
 
 // data: data send in establish step (can be nil).
 func (e *DefaultProxyEst) establish(hub *Hub, id ksuid.KSUID, proxyType int, addr string, data []byte) error {
-	conn, err := net.DialTimeout("tcp", addr, time.Second*8) // todo config timeout
+	conn, err := e.dialer.Dial("tcp", addr)
 	if err != nil {
-		return err
+		return newProxyEstError(err)
 	}
-	e.tcpConn = conn
-	defer conn.Close()
-
-	e.done = make(chan ChanDone, 2)
-	//defer close(done)
+	// data received by client after the header of proxy protocol.
+	if len(data) > 0 {
+		if _, err := conn.Write(data); err != nil {
+			conn.Close()
+			return newProxyEstError(err)
+		}
+	}
+	e.start(hub, id, conn)
 
 	// todo check exists
-	hub.addNewProxy(&ProxyServer{Id: id, ProxyIns: e})
+	proxy := &ProxyServer{Id: id, ProxyIns: e, window: hub.newSendWindow()}
+	hub.addNewProxy(proxy)
 	defer hub.RemoveProxy(id)
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-	defer cancel()
+	var reply []byte
 	switch proxyType {
 	case ProxyTypeSocks5:
-		if err := hub.WriteProxyMessage(ctx, id, TagData, []byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}); err != nil {
+		reply = []byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	case ProxyTypeSocks4:
+		reply = []byte{0x00, socks4Granted, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	case ProxyTypeHttps:
+		reply = []byte("HTTP/1.0 200 Connection Established\r\nProxy-agent: wssocks\r\n\r\n")
+	case ProxyTypeTransparent, ProxyTypeForward:
+		// client starts sending data after it is told that the proxy is established.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := hub.WriteProxyMessage(ctx, id, TagEstOk, nil); err != nil {
+			if e.receiver != nil {
+				e.receiver.Close()
+			}
+			conn.Close()
 			return err
 		}
-	case ProxyTypeHttps:
-		if err := hub.WriteProxyMessage(ctx, id, TagData, []byte("HTTP/1.0 200 Connection Established\r\nProxy-agent: wssocks\r\n\r\n")); err != nil {
+	}
+	return e.serve(hub, proxy, reply)
+}
+
+// start receiving data from client and writing it to conn (the connection to the target).
+// It must be called before the proxy can receive data from client.
+func (e *DefaultProxyEst) start(hub *Hub, id ksuid.KSUID, conn net.Conn) {
+	e.tcpConn = conn
+	e.done = make(chan ChanDone, 4)
+	//defer close(done)
+
+	if e.receiver = hub.newFlowReceiver(id); e.receiver != nil {
+		go func() {
+			if err := e.receiver.copyTo(conn); err != nil {
+				e.finish(ChanDone{tell: true, err: err})
+			} else {
+				e.onDrained()
+			}
+		}()
+	}
+}
+
+// write reply (can be nil) to client, and copy data between client and the target,
+// until both directions are finished, or the proxy is closed.
+// The connection to the target is closed after serving.
+func (e *DefaultProxyEst) serve(hub *Hub, proxy *ProxyServer, reply []byte) error {
+	id := proxy.Id
+	conn := e.tcpConn
+	defer conn.Close()
+	if e.receiver != nil {
+		defer e.receiver.Close()
+	}
+
+	if reply != nil {
+		if err := writeProxyReply(hub, proxy, reply); err != nil {
 			return err
 		}
 	}
 
 	go func() {
-		writer := NewWebSocketWriter(&hub.ConcurrentWebSocket, id, context.Background())
+		writer := hub.newProxyWriter(proxy, context.Background())
 		if _, err := io.Copy(writer, conn); err != nil {
 			log.Error("copy error,", err)
-			e.done <- ChanDone{true, err}
+			e.finish(ChanDone{tell: true, err: err})
+			return
 		}
-		e.done <- ChanDone{true, nil}
+		if !e.halfClose {
+			e.finish(ChanDone{tell: true})
+			return
+		}
+		// tell client there is no more data, but data from client can still be sent to the target.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := hub.WriteProxyMessage(ctx, id, TagNoMore, nil); err != nil {
+			e.finish(ChanDone{tell: true, err: err})
+			return
+		}
+		e.finish(ChanDone{half: true})
 	}()
 
-	d := <-e.done
-	// s.RemoveProxy(proxy.Id)
-	// tellClosed is called outside this func.
-	return d.err
+	// wait until both directions are finished, or the proxy is closed.
+	for halves := 0; halves < 2; halves++ {
+		if d := <-e.done; !d.half {
+			// s.RemoveProxy(proxy.Id)
+			// tellClosed is called outside this func.
+			return d.err
+		}
+	}
+	return nil
+}
+
+// write the reply of establishing to client.
+// The reply is also sent under flow control, as it is a part of proxy data.
+func writeProxyReply(hub *Hub, proxy *ProxyServer, reply []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := hub.newProxyWriter(proxy, ctx).Write(reply)
+	return err
 }
 
 type HttpProxyEst struct {
-	bodyReadCloser *BufferedWR
+	bodyReadCloser *flowReceiver
+	keepAlive      bool // client can reuse its connection, if the response is delimited
+	upgrade        bool // upgrade requests are supported by client
+	transport      *http.Transport
 }
 
-func makeHttpProxyInstance() *HttpProxyEst {
-	buf := NewBufferWR()
-	return &HttpProxyEst{bodyReadCloser: buf}
+func makeHttpProxyInstance(hub *Hub, id ksuid.KSUID, transport *http.Transport) *HttpProxyEst {
+	buf := hub.newFlowReceiver(id)
+	if buf == nil { // flow control is disabled
+		buf = newFlowReceiver(nil)
+	}
+	return &HttpProxyEst{
+		bodyReadCloser: buf,
+		keepAlive:      hub.HasFeature(FeatureHttpKeepAlive),
+		upgrade:        hub.HasFeature(FeatureHttpUpgrade),
+		transport:      transport,
+	}
 }
 
 func (h *HttpProxyEst) onData(data ClientData) error {
 	if data.Tag == TagNoMore {
 		return h.bodyReadCloser.Close() // close due to no more data.
 	}
+	// if the window is exceeded, reading the body fails and the request is aborted.
 	if _, err := h.bodyReadCloser.Write(data.Data); err != nil {
 		return err
 	}
@@ -214,7 +362,7 @@ func (h *HttpProxyEst) Close(tell bool) error {
 	return h.bodyReadCloser.Close() // close from client
 }
 
-func (h *HttpProxyEst) establish(hub *Hub, id ksuid.KSUID, proxyType int, addr string, header []byte) error {
+func (h *HttpProxyEst) establish(hub *Hub, id ksuid.KSUID, proxyType int, addr string, header []byte) (err error) {
 	if header == nil {
 		hub.tellClosed(id)
 		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
@@ -228,10 +376,13 @@ func (h *HttpProxyEst) establish(hub *Hub, id ksuid.KSUID, proxyType int, addr s
 	defer close(closed)
 	defer close(client)
 
-	hub.addNewProxy(&ProxyServer{Id: id, ProxyIns: h})
+	proxy := &ProxyServer{Id: id, ProxyIns: h, window: hub.newSendWindow()}
+	hub.addNewProxy(proxy)
 	defer hub.RemoveProxy(id)
 	defer func() {
-		if !h.bodyReadCloser.isClosed() { // if it is not closed by client.
+		var estErr *ProxyEstError
+		// if it is not closed by client (the failure of establishing is told outside this func).
+		if !h.bodyReadCloser.buffer.isClosed() && !errors.As(err, &estErr) {
 			hub.tellClosed(id) // todo
 		}
 	}()
@@ -244,25 +395,95 @@ func (h *HttpProxyEst) establish(hub *Hub, id ksuid.KSUID, proxyType int, addr s
 
 	// get http request by header bytes.
 	bufferHeader := bufio.NewReader(bytes.NewBuffer(header))
-	req, err := http.ReadRequest(bufferHeader)
+	req, names, err := readRequest(bufferHeader)
 	if err != nil {
 		return err
 	}
 	req.Body = h.bodyReadCloser
+	upgrade := h.upgrade && isUpgradeRequest(req.Header)
+	if upgrade {
+		keepUpgradeHeaders(req.Header, req.Header.Get("Upgrade"))
+		// data after the body is for the upgraded connection.
+		req.Body = ioutil.NopCloser(io.LimitReader(h.bodyReadCloser, req.ContentLength))
+	} else {
+		removeHopHeaders(req.Header) // in case of older clients, and req.Close is kept for the transport.
+	}
+	if _, ok := req.Header["User-Agent"]; !ok {
+		req.Header["User-Agent"] = []string{""} // not to add the default user agent of transport
+	}
+	restoreHeaderCase(req.Header, names)
 
 	// read request and copy response back
-	resp, err := http.DefaultTransport.RoundTrip(req)
+	resp, err := h.transport.RoundTrip(req)
 	if err != nil {
-		return fmt.Errorf("transport error: %w", err)
+		return newProxyEstError(fmt.Errorf("transport error: %w", err))
 	}
 	defer resp.Body.Close()
 
-	writer := NewWebSocketWriter(&hub.ConcurrentWebSocket, id, context.Background())
+	writer := hub.newProxyWriter(proxy, context.Background())
+	if upgrade && resp.StatusCode == http.StatusSwitchingProtocols {
+		return h.relayUpgraded(writer, resp)
+	}
+	chunked := h.frameResponse(req, resp)
 	var headerBuffer bytes.Buffer
 	HttpRespHeader(&headerBuffer, resp)
 	writer.Write(headerBuffer.Bytes())
-	if _, err := io.Copy(writer, resp.Body); err != nil {
+	if !chunked {
+		if _, err := io.Copy(writer, resp.Body); err != nil {
+			return fmt.Errorf("http body copy error: %w", err)
+		}
+		return nil
+	}
+	cw := httputil.NewChunkedWriter(writer)
+	if _, err := io.Copy(cw, resp.Body); err != nil {
 		return fmt.Errorf("http body copy error: %w", err)
 	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	_, err = writer.Write([]byte("\r\n")) // no trailer
+	return err
+}
+
+// write the 101 response of an upgrade request to client, and relay the data between client and the upgraded connection,
+// like https(CONNECT) proxy. It returns after one side is closed.
+func (h *HttpProxyEst) relayUpgraded(writer io.Writer, resp *http.Response) error {
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return errors.New("upgraded connection is not writable")
+	}
+	keepUpgradeHeaders(resp.Header, resp.Header.Get("Upgrade"))
+	var headerBuffer bytes.Buffer
+	HttpRespHeader(&headerBuffer, resp)
+	if _, err := writer.Write(headerBuffer.Bytes()); err != nil {
+		return err
+	}
+
+	go func() {
+		_, _ = io.Copy(conn, h.bodyReadCloser) // until client is closed
+		_ = conn.Close()
+	}()
+	_, _ = io.Copy(writer, conn) // the error of closed connection is expected
+	_ = h.bodyReadCloser.Close()
 	return nil
 }
+
+// set the headers of resp to tell how the response is delimited, and returns true if the body must be chunked.
+// If client can keep its connection (see httpKeepAlive), the response is delimited by Content-Length or chunked encoding,
+// otherwise the connection is closed after the response.
+func (h *HttpProxyEst) frameResponse(req *http.Request, resp *http.Response) bool {
+	removeHopHeaders(resp.Header)
+	if !h.keepAlive || !httpKeepAlive(req) {
+		resp.Header.Set("Connection", "close")
+		return false
+	}
+	if !httpBodyAllowed(req.Method, resp.StatusCode) {
+		return false
+	}
+	if resp.ContentLength >= 0 {
+		resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+		return false
+	}
+	resp.Header.Set("Transfer-Encoding", "chunked")
+	return true
+}
@@ -0,0 +1,176 @@
+package wss
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+// time to wait for the incoming connection of socks5 BIND.
+const bindAcceptTimeout = 2 * time.Minute
+
+// interface implementation for socks5 BIND.
+// Server listens for the incoming connection from the target, and reports the listening address in the first reply.
+// After the connection is accepted, the second reply is sent, and the connection is served as a DefaultProxyEst.
+type BindProxyEst struct {
+	halfClose bool // half-close is negotiated with client
+	mu        sync.Mutex
+	listener  *net.TCPListener
+	closed    bool             // closed by client before accepting the connection
+	closeErr  error            // returned by establish if it is closed before accepting
+	est       *DefaultProxyEst // the proxy of the accepted connection, nil before accepting
+}
+
+func (b *BindProxyEst) onData(data ClientData) error {
+	b.mu.Lock()
+	est := b.est
+	b.mu.Unlock()
+	if est != nil {
+		return est.onData(data)
+	}
+	if data.Tag == TagNoMore {
+		// proxy client application is gone before the connection comes, and client is told to close after returning.
+		b.stop(nil)
+	}
+	return nil // no connection to write yet, the data is dropped.
+}
+
+func (b *BindProxyEst) Close(tell bool) error {
+	if est := b.stop(ConnCloseByClient); est != nil {
+		return est.Close(tell)
+	}
+	return nil
+}
+
+// stop accepting if the connection is not accepted yet, otherwise the proxy of accepted connection is returned.
+func (b *BindProxyEst) stop(err error) *DefaultProxyEst {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.est == nil && !b.closed {
+		b.closed = true
+		b.closeErr = err
+		if b.listener != nil {
+			_ = b.listener.Close()
+		}
+	}
+	return b.est
+}
+
+// addr is the address in the BIND request, which is the expected host to connect.
+func (b *BindProxyEst) establish(hub *Hub, id ksuid.KSUID, proxyType int, addr string, data []byte) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return &ProxyEstError{Code: EstErrGeneral, Message: err.Error()}
+	}
+	// listen on the interface to reach the expected host, so that the address is reachable for it.
+	ip, expected, err := bindIP(host)
+	if err != nil {
+		return newProxyEstError(err)
+	}
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip})
+	if err != nil {
+		return newProxyEstError(err)
+	}
+	if ip == nil {
+		// listening on all interfaces, the address which client connects to server is reported instead.
+		ip = hub.LocalIP()
+	}
+	defer listener.Close()
+	b.mu.Lock()
+	b.listener = listener
+	closed, closeErr := b.closed, b.closeErr
+	b.mu.Unlock()
+	if closed {
+		return closeErr
+	}
+
+	proxy := &ProxyServer{Id: id, ProxyIns: b, window: hub.newSendWindow()}
+	hub.addNewProxy(proxy)
+	defer hub.RemoveProxy(id)
+
+	// the first reply: the address of listener.
+	bound := listener.Addr().(*net.TCPAddr)
+	if err := writeProxyReply(hub, proxy, appendSocks5Addr([]byte{0x05, 0x00, 0x00}, ip, bound.Port)); err != nil {
+		return err
+	}
+
+	_ = listener.SetDeadline(time.Now().Add(bindAcceptTimeout))
+	var conn *net.TCPConn
+	for conn == nil {
+		c, err := listener.AcceptTCP()
+		if err != nil {
+			b.mu.Lock()
+			closed, closeErr := b.closed, b.closeErr
+			b.mu.Unlock()
+			if closed {
+				return closeErr
+			}
+			return newProxyEstError(err)
+		}
+		// only the expected host can connect, if it is given in the request.
+		if expected != nil && !containsIP(expected, c.RemoteAddr().(*net.TCPAddr).IP) {
+			_ = c.Close()
+			continue
+		}
+		conn = c
+	}
+
+	est := &DefaultProxyEst{halfClose: b.halfClose}
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		_ = conn.Close()
+		return b.closeErr
+	}
+	est.start(hub, id, conn)
+	b.est = est
+	b.mu.Unlock()
+
+	// the second reply: the address of the connecting host.
+	remote := conn.RemoteAddr().(*net.TCPAddr)
+	return est.serve(hub, proxy, appendSocks5Addr([]byte{0x05, 0x00, 0x00}, remote.IP, remote.Port))
+}
+
+// resolve the expected host in BIND request, and find the ip of local interface to reach it.
+// If host is an unspecified ip, any host can connect (expected is nil),
+// and nil ip is returned to listen on all interfaces, as well as when no route to host is found.
+func bindIP(host string) (ip net.IP, expected []net.IP, err error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsUnspecified() {
+			return nil, nil, nil
+		}
+		expected = []net.IP{ip}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		defer cancel()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, addr := range addrs {
+			expected = append(expected, addr.IP)
+		}
+		if len(expected) == 0 {
+			return nil, nil, &net.DNSError{Err: "no such host", Name: host}
+		}
+	}
+	// no packet is sent by dialing udp, it only finds the route.
+	conn, err := net.Dial("udp", net.JoinHostPort(expected[0].String(), "9"))
+	if err != nil {
+		return nil, expected, nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, expected, nil
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package wss
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultUdpIdleTimeout is the default time to keep a udp association on server without any datagram.
+const DefaultUdpIdleTimeout = 2 * time.Minute
+
+// interface implementation for socks5 UDP ASSOCIATE.
+// Each association owns a udp socket on server, which relays the datagrams to and from the targets.
+type UdpProxyEst struct {
+	conn   *net.UDPConn
+	idle   time.Duration // the association is closed after idle timeout without any datagram
+	active int64         // unix time in nanoseconds of the last datagram, accessed atomically
+	done   chan ChanDone
+}
+
+func newUdpProxyEst(idle time.Duration) *UdpProxyEst {
+	if idle <= 0 {
+		idle = DefaultUdpIdleTimeout
+	}
+	return &UdpProxyEst{idle: idle, done: make(chan ChanDone, 2)}
+}
+
+func (u *UdpProxyEst) touch() {
+	atomic.StoreInt64(&u.active, time.Now().UnixNano())
+}
+
+// send a datagram from client to its destination.
+func (u *UdpProxyEst) onData(data ClientData) error {
+	host, port, payload, err := parseSocks5Addr(data.Data)
+	if err != nil {
+		return err
+	}
+	u.touch()
+	if ip := net.ParseIP(host); ip != nil {
+		if _, err := u.conn.WriteToUDP(payload, &net.UDPAddr{IP: ip, Port: port}); err != nil {
+			log.WithField("address", host).Debug("udp write error: ", err)
+		}
+		return nil
+	}
+	// resolve the domain without blocking the websocket reading.
+	payload = append([]byte(nil), payload...)
+	go func() {
+		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			log.WithField("address", host).Debug("udp resolve error: ", err)
+			return
+		}
+		if _, err := u.conn.WriteToUDP(payload, addr); err != nil {
+			log.WithField("address", host).Debug("udp write error: ", err)
+		}
+	}()
+	return nil
+}
+
+func (u *UdpProxyEst) Close(tell bool) error {
+	select {
+	case u.done <- ChanDone{tell: tell, err: ConnCloseByClient}:
+	default:
+	}
+	return nil
+}
+
+// addr is the address in the UDP ASSOCIATE request, which is not used.
+func (u *UdpProxyEst) establish(hub *Hub, id ksuid.KSUID, proxyType int, addr string, data []byte) error {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return newProxyEstError(err)
+	}
+	u.conn = conn
+	defer conn.Close()
+	u.touch()
+
+	proxy := &ProxyServer{Id: id, ProxyIns: u} // datagrams are not under flow control
+	hub.addNewProxy(proxy)
+	defer hub.RemoveProxy(id)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := hub.WriteProxyMessage(ctx, id, TagEstOk, nil); err != nil {
+		return err
+	}
+
+	// datagrams from the targets
+	go func() {
+		buffer := make([]byte, maxDatagramSize)
+		for {
+			n, from, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				select {
+				case u.done <- ChanDone{tell: true, err: err}:
+				default:
+				}
+				return
+			}
+			u.touch()
+			datagram := appendSocks5Addr(make([]byte, 0, 19+n), from.IP, from.Port)
+			if err := hub.WriteDatagram(ctx, id, append(datagram, buffer[:n]...)); err != nil {
+				select {
+				case u.done <- ChanDone{tell: true, err: err}:
+				default:
+				}
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(u.idle / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case d := <-u.done:
+			return d.err
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&u.active))) > u.idle {
+				log.WithField("timeout", u.idle).Debug("udp association expired.")
+				return nil // tellClosed is called outside this func.
+			}
+		}
+	}
+}
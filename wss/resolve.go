@@ -0,0 +1,198 @@
+package wss
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// remote dns resolution (feature FeatureResolve):
+// client sends a WsTpResolve message with a ResolveRequest, and server replies a WsTpResolved message
+// with the same id, which carries the lookup results of server.
+// The messages are not numbered in resumable session, a request lost in reconnecting is failed by its context.
+
+// time limit of a lookup on server.
+const resolveTimeout = 10 * time.Second
+
+var ErrResolveNotSupported = errors.New("remote dns resolution is not supported by server")
+
+// ResolveRequest asks server to look up the addresses of a host name,
+// or the names of an ip address if Reverse is true.
+type ResolveRequest struct {
+	Name    string `json:"name"`
+	Reverse bool   `json:"reverse"`
+}
+
+// ResolveResponse is the lookup results of server.
+type ResolveResponse struct {
+	Addrs []string `json:"addrs"` // ip addresses, or host names of reverse lookup
+	Error string   `json:"error"` // empty if the lookup succeeds
+}
+
+// look up the request on server, and reply the results to client.
+func (h *Hub) resolve(id ksuid.KSUID, req ResolveRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+
+	var resp ResolveResponse
+	if req.Reverse {
+		if names, err := net.DefaultResolver.LookupAddr(ctx, req.Name); err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Addrs = names
+		}
+	} else {
+		if addrs, err := net.DefaultResolver.LookupIPAddr(ctx, req.Name); err != nil {
+			resp.Error = err.Error()
+		} else {
+			for _, addr := range addrs {
+				resp.Addrs = append(resp.Addrs, addr.IP.String())
+			}
+		}
+	}
+	if err := h.WriteMessage(ctx, id, WsTpResolved, resp); err != nil {
+		log.Error("write resolve response error: ", err)
+	}
+}
+
+// pending resolve requests of a websocket client, waiting for the responses from server.
+type resolveRequests struct {
+	mu      sync.Mutex
+	pending map[ksuid.KSUID]chan ResolveResponse
+}
+
+func (r *resolveRequests) add(id ksuid.KSUID) chan ResolveResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pending == nil {
+		r.pending = make(map[ksuid.KSUID]chan ResolveResponse)
+	}
+	ch := make(chan ResolveResponse, 1)
+	r.pending[id] = ch
+	return ch
+}
+
+func (r *resolveRequests) remove(id ksuid.KSUID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.pending, id)
+}
+
+// deliver the response to the pending request.
+func (r *resolveRequests) onResolved(frame *Frame) error {
+	var resp ResolveResponse
+	if err := json.Unmarshal(frame.Body, &resp); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ch, ok := r.pending[frame.Id]; ok {
+		ch <- resp
+		delete(r.pending, frame.Id)
+	}
+	return nil
+}
+
+// send a resolve request to server and wait for the response.
+func (wsc *WebSocketClient) resolve(ctx context.Context, req ResolveRequest) ([]string, error) {
+	if !wsc.HasFeature(FeatureResolve) {
+		return nil, ErrResolveNotSupported
+	}
+	id := ksuid.New()
+	ch := wsc.resolves.add(id)
+	defer wsc.resolves.remove(id)
+	if err := wsc.WriteMessage(ctx, id, WsTpResolve, req); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-ch:
+		if resp.Error != "" {
+			return nil, &net.DNSError{Err: resp.Error, Name: req.Name, Server: "wssocks server"}
+		}
+		return resp.Addrs, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// LookupIP looks up host on server, and returns the ip addresses of host seen by server.
+func (wsc *WebSocketClient) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := wsc.resolve(ctx, ResolveRequest{Name: host})
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+// LookupAddr performs a reverse lookup of ip on server, and returns the names mapping to ip.
+func (wsc *WebSocketClient) LookupAddr(ctx context.Context, ip net.IP) ([]string, error) {
+	return wsc.resolve(ctx, ResolveRequest{Name: ip.String(), Reverse: true})
+}
+
+// handle socks5 RESOLVE and RESOLVE_PTR (tor extensions) of the proxy client application on conn,
+// the lookup is performed on server, and the first result is replied in the BND.ADDR field.
+func (client *Client) resolve(wsc *WebSocketClient, conn *net.TCPConn, proxyType int, addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		_ = writeSocks5Reply(conn, 0x01, nil, 0)
+		return err
+	}
+	// the lookup on server is limited by resolveTimeout, and the rest is left for the round trip.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*resolveTimeout)
+	defer cancel()
+
+	if proxyType == ProxyTypeSocks5ResolvePtr {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			_ = writeSocks5Reply(conn, 0x08, nil, 0) // address type not supported
+			return fmt.Errorf("RESOLVE_PTR of a non-ip address %s", host)
+		}
+		names, err := wsc.LookupAddr(ctx, ip)
+		if err == nil && len(names) == 0 {
+			err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		if err != nil {
+			_ = writeSocks5Reply(conn, 0x04, nil, 0) // host unreachable
+			return err
+		}
+		name := strings.TrimSuffix(names[0], ".")
+		if len(name) > 255 {
+			name = name[:255]
+		}
+		reply := append([]byte{0x05, 0x00, 0x00, socks5AddrDomain, byte(len(name))}, name...)
+		_, err = conn.Write(append(reply, 0, 0))
+		return err
+	}
+
+	ips, err := wsc.LookupIP(ctx, host)
+	if err == nil && len(ips) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if err != nil {
+		_ = writeSocks5Reply(conn, 0x04, nil, 0) // host unreachable
+		return err
+	}
+	// prefer ipv4 address, as the socks5 clients (e.g. tor-resolve) usually expect.
+	ip := ips[0]
+	for _, v := range ips {
+		if v.To4() != nil {
+			ip = v
+			break
+		}
+	}
+	return writeSocks5Reply(conn, 0x00, ip, 0)
+}
@@ -0,0 +1,94 @@
+package wss
+
+import (
+	"context"
+	"sync"
+
+	"github.com/segmentio/ksuid"
+	"nhooyr.io/websocket"
+)
+
+// an encoded frame waiting in the send queue.
+type queuedFrame struct {
+	ctx     context.Context
+	id      ksuid.KSUID // stream id of the frame
+	tp      string      // message type, e.g. WsTpData
+	msgType websocket.MessageType
+	data    []byte
+	done    chan error // result of writing, it is buffered.
+}
+
+// sendQueue holds the frames to be written to a websocket, it is drained by a single writer.
+// Control frames are written first, and data frames are round-robined across streams,
+// thus a bulk transfer on one stream can not starve the others.
+// Frames on the same stream keep their order:
+// a control frame which must follow the data of its stream (e.g. close) waits behind the data.
+type sendQueue struct {
+	mu      sync.Mutex
+	control []*queuedFrame
+	streams map[ksuid.KSUID][]*queuedFrame // pending frames of each stream
+	ring    []ksuid.KSUID                  // streams with pending frames, in round-robin order
+	running bool                           // the writer is running
+}
+
+// frames carrying payload of streams, which are scheduled fairly between streams.
+func isStreamFrame(tp string) bool {
+	return tp == WsTpData || tp == WsTpDatagram
+}
+
+// whether a frame of message type tp can be written before the pending data of its stream.
+func isUrgentFrame(tp string) bool {
+	return tp == WsTpBeats || tp == WsTpAck || tp == WsTpWindow
+}
+
+// add a frame to the queue.
+// It returns true if there is no writer running, and the caller should start one.
+func (q *sendQueue) push(f *queuedFrame) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	pending, ok := q.streams[f.id]
+	if !isStreamFrame(f.tp) && (!ok || isUrgentFrame(f.tp)) {
+		q.control = append(q.control, f)
+	} else {
+		if q.streams == nil {
+			q.streams = make(map[ksuid.KSUID][]*queuedFrame)
+		}
+		if !ok {
+			q.ring = append(q.ring, f.id)
+		}
+		q.streams[f.id] = append(pending, f)
+	}
+	if q.running {
+		return false
+	}
+	q.running = true
+	return true
+}
+
+// take the next frame to be written.
+// If the queue is empty, it returns nil and the writer should exit.
+func (q *sendQueue) pop() *queuedFrame {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.control) > 0 {
+		f := q.control[0]
+		q.control[0] = nil
+		q.control = q.control[1:]
+		return f
+	}
+	if len(q.ring) == 0 {
+		q.running = false
+		return nil
+	}
+	id := q.ring[0]
+	q.ring = q.ring[1:]
+	pending := q.streams[id]
+	f := pending[0]
+	if len(pending) > 1 {
+		q.streams[id] = pending[1:]
+		q.ring = append(q.ring, id) // the stream goes to the end of the round.
+	} else {
+		delete(q.streams, id)
+	}
+	return f
+}
@@ -0,0 +1,45 @@
+package wss
+
+import (
+	"testing"
+
+	"github.com/segmentio/ksuid"
+)
+
+func TestSendQueueOrder(t *testing.T) {
+	a, b := ksuid.New(), ksuid.New()
+	var q sendQueue
+	frame := func(id ksuid.KSUID, tp string) *queuedFrame {
+		return &queuedFrame{id: id, tp: tp}
+	}
+	if !q.push(frame(a, WsTpData)) {
+		t.Fatal("the first push should start a writer")
+	}
+	q.push(frame(a, WsTpData))
+	q.push(frame(a, WsTpClose)) // must follow the data of stream a
+	q.push(frame(b, WsTpData))
+	q.push(frame(b, WsTpWindow)) // urgent, can overtake
+	if q.push(frame(ksuid.Nil, WsTpBeats)) {
+		t.Fatal("only one writer should be started")
+	}
+
+	expected := []struct {
+		id ksuid.KSUID
+		tp string
+	}{
+		{b, WsTpWindow}, {ksuid.Nil, WsTpBeats}, // control frames first
+		{a, WsTpData}, {b, WsTpData}, {a, WsTpData}, {a, WsTpClose}, // round-robin
+	}
+	for i, e := range expected {
+		f := q.pop()
+		if f == nil || f.id != e.id || f.tp != e.tp {
+			t.Fatalf("frame %d: expect %s of %s, but got %+v", i, e.tp, e.id, f)
+		}
+	}
+	if q.pop() != nil {
+		t.Fatal("queue should be empty")
+	}
+	if !q.push(frame(a, WsTpData)) {
+		t.Error("a new writer should be started after the queue is drained")
+	}
+}
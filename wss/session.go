@@ -0,0 +1,149 @@
+package wss
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+// send an ack message after receiving this count of frames.
+const sessionAckInterval = 32
+
+// DefaultSessionGrace is the default time to keep a session on server after its websocket connection is lost.
+const DefaultSessionGrace = time.Minute
+
+// ack message of a resumable session.
+// Seq is the count of frames received from the peer in this session.
+type SessionAck struct {
+	Seq uint64 `json:"seq"`
+}
+
+// a frame that is sent but not acknowledged by the peer.
+type sessionFrame struct {
+	seq     uint64
+	msgType websocket.MessageType
+	data    []byte
+}
+
+// session makes the proxy connections on a websocket survive a reconnection of the websocket.
+// All frames except heartbeats and acks are numbered implicitly in the order of sending
+// (websocket keeps the order), and kept until the peer acknowledges them.
+// After the websocket is reconnected, both sides tell the count of frames they have received,
+// and then resend the frames which are not received by the peer.
+type session struct {
+	id string
+
+	mu      sync.Mutex     // lock for numbering and writing frames
+	sendSeq uint64         // seq of the last sent frame
+	queue   []sessionFrame // frames not acknowledged yet
+
+	recvMu  sync.Mutex
+	recvSeq uint64 // count of frames received from the peer
+	acked   uint64 // recvSeq last acknowledged to the peer (the ack message is written)
+	acking  bool   // an ack message is being written
+}
+
+func newSession(id string) *session {
+	return &session{id: id}
+}
+
+// generate a random session token.
+func newSessionId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// whether a frame of message type tp is numbered (and resent after resuming).
+func isSessionFrame(tp string) bool {
+	return tp != WsTpBeats && tp != WsTpAck && tp != WsTpResolve && tp != WsTpResolved
+}
+
+// write a numbered frame on conn, the frame is kept for resending.
+// If the websocket connection is broken, the error is ignored, because the frame will be resent after resuming.
+func (s *session) write(ctx context.Context, wsc *ConcurrentWebSocket, msgType websocket.MessageType, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sendSeq++
+	s.queue = append(s.queue, sessionFrame{seq: s.sendSeq, msgType: msgType, data: data})
+	if err := wsc.conn().Write(ctx, msgType, data); err != nil && ctx.Err() != nil {
+		return err // canceled by caller
+	}
+	return nil
+}
+
+// remove the frames acknowledged by the peer.
+func (s *session) onAck(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trim(seq)
+}
+
+// must be called with lock held.
+func (s *session) trim(seq uint64) {
+	i := 0
+	for i < len(s.queue) && s.queue[i].seq <= seq {
+		i++
+	}
+	if i > 0 {
+		s.queue = append([]sessionFrame(nil), s.queue[i:]...)
+	}
+}
+
+// count a received frame, and return true if an ack message should be sent.
+// It returns false if an ack message is being written, the frame is acknowledged by the next ack message.
+func (s *session) onReceived() bool {
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+	s.recvSeq++
+	if s.acking || s.recvSeq-s.acked < sessionAckInterval {
+		return false
+	}
+	s.acking = true
+	return true
+}
+
+// called after an ack message of seq is written (ok is true) or failed to write.
+// It returns true if another ack message should be sent, for the frames received while writing.
+func (s *session) onAckSent(seq uint64, ok bool) bool {
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+	if ok && seq > s.acked {
+		s.acked = seq
+	}
+	if ok && s.recvSeq-s.acked >= sessionAckInterval {
+		return true
+	}
+	s.acking = false
+	return false
+}
+
+func (s *session) received() uint64 {
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+	return s.recvSeq
+}
+
+// switch to the new websocket connection, and resend the frames which are not received by the peer.
+// peerRecvSeq is the count of frames the peer has received.
+func (s *session) resume(wsc *ConcurrentWebSocket, conn *websocket.Conn, peerRecvSeq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wsc.setConn(conn)
+	s.trim(peerRecvSeq)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, frame := range s.queue {
+		if err := conn.Write(ctx, frame.msgType, frame.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package wss
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+	"nhooyr.io/websocket"
+)
+
+// a pair of connected websockets, served by a httptest server.
+// The returned function closes both websockets and the server.
+func newWebSocketPair(t *testing.T) (client, server *websocket.Conn, closePair func()) {
+	t.Helper()
+	accepted := make(chan *websocket.Conn, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, err := websocket.Accept(w, r, nil); err == nil {
+			accepted <- conn
+		}
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(s.URL, "http"), nil)
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	server = <-accepted
+	return client, server, func() {
+		// read in background, so that the close handshake can be finished.
+		client.CloseRead(context.Background())
+		server.CloseRead(context.Background())
+		client.Close(websocket.StatusNormalClosure, "")
+		server.Close(websocket.StatusNormalClosure, "")
+		s.Close()
+	}
+}
+
+func TestSessionTrim(t *testing.T) {
+	tests := []struct {
+		ack  uint64
+		left []uint64 // seq of frames left in queue
+	}{
+		{0, []uint64{1, 2, 3, 4, 5}},
+		{1, []uint64{2, 3, 4, 5}},
+		{3, []uint64{4, 5}},
+		{5, nil},
+		{8, nil}, // ack beyond the sent frames
+	}
+	for _, test := range tests {
+		s := newSession("test")
+		for seq := uint64(1); seq <= 5; seq++ {
+			s.queue = append(s.queue, sessionFrame{seq: seq})
+		}
+		s.onAck(test.ack)
+		var left []uint64
+		for _, f := range s.queue {
+			left = append(left, f.seq)
+		}
+		if !reflect.DeepEqual(left, test.left) {
+			t.Errorf("ack %d: expect frames %v left, but got %v", test.ack, test.left, left)
+		}
+	}
+}
+
+func TestSessionOnReceived(t *testing.T) {
+	tests := []struct {
+		name   string
+		during uint64 // frames received while the ack message is being written
+		ok     bool   // the ack message is written
+		more   bool   // another ack message should be sent
+		acked  uint64
+	}{
+		{"written", 5, true, false, sessionAckInterval},
+		{"written, many frames received meanwhile", sessionAckInterval, true, true, sessionAckInterval},
+		{"failed", 5, false, false, 0},
+	}
+	for _, test := range tests {
+		s := newSession("test")
+		for i := 1; i < sessionAckInterval; i++ {
+			if s.onReceived() {
+				t.Fatalf("%s: frame %d should not be acknowledged", test.name, i)
+			}
+		}
+		if !s.onReceived() {
+			t.Fatalf("%s: frame %d should be acknowledged", test.name, sessionAckInterval)
+		}
+		seq := s.received()
+		for i := uint64(0); i < test.during; i++ {
+			if s.onReceived() {
+				t.Fatalf("%s: only one ack message should be written at a time", test.name)
+			}
+		}
+		if more := s.onAckSent(seq, test.ok); more != test.more || s.acked != test.acked {
+			t.Errorf("%s: expect more %v and acked %d, but got %v and %d", test.name, test.more, test.acked, more, s.acked)
+		}
+		// the frames not acknowledged trigger the next ack, unless the ack message is still being written.
+		if more := s.onReceived(); more != (!test.more && s.received()-s.acked >= sessionAckInterval) {
+			t.Errorf("%s: unexpected ack after %d frames received, acked %d", test.name, s.received(), s.acked)
+		}
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	tests := []struct {
+		peerRecvSeq uint64
+		resent      []byte // payloads of the resent frames
+	}{
+		{0, []byte{1, 2, 3, 4, 5}},
+		{2, []byte{3, 4, 5}},
+		{5, nil},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	id := ksuid.New()
+	for _, test := range tests {
+		s := newSession("test")
+		oldClient, _, closeOld := newWebSocketPair(t)
+		defer closeOld()
+		wsc := &ConcurrentWebSocket{WsConn: oldClient, session: s, binary: true}
+		for i := byte(1); i <= 5; i++ {
+			if err := s.write(ctx, wsc, websocket.MessageBinary, encodeDataFrame(id, TagData, []byte{i})); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		client, server, closeNew := newWebSocketPair(t)
+		defer closeNew()
+		if err := s.resume(wsc, client, test.peerRecvSeq); err != nil {
+			t.Fatal(err)
+		}
+		if wsc.conn() != client {
+			t.Fatal("session should switch to the new websocket connection")
+		}
+		// the frames written after resuming follow the resent ones.
+		if err := s.write(ctx, wsc, websocket.MessageBinary, encodeDataFrame(id, TagData, []byte{6})); err != nil {
+			t.Fatal(err)
+		}
+		var received []byte
+		for {
+			msgType, data, err := server.Read(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			frame, err := decodeFrame(msgType, data, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if frame.Data[0] == 6 {
+				break
+			}
+			received = append(received, frame.Data...)
+		}
+		if !bytes.Equal(received, test.resent) {
+			t.Errorf("peer received %d frames: expect resent %v, but got %v", test.peerRecvSeq, test.resent, received)
+		}
+		if s.sendSeq != 6 || len(s.queue) != int(6-test.peerRecvSeq) {
+			t.Errorf("peer received %d frames: unexpected sent seq %d and %d frames in queue", test.peerRecvSeq, s.sendSeq, len(s.queue))
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package wss
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// socks5 authentication methods
+const (
+	socks5MethodNoAuth       = 0x00
+	socks5MethodUserPass     = 0x02
+	socks5MethodNoAcceptable = 0xFF
+)
+
+// CheckSocks5 returns an error if a username or password in c can not be sent in
+// socks5 username/password authentication (see rfc 1929, https://tools.ietf.org/html/rfc1929),
+// where they must be at most 255 bytes.
+func (c Credentials) CheckSocks5() error {
+	for user, pass := range c {
+		if len(user) > 255 || len(pass) > 255 {
+			return fmt.Errorf("username and password of socks5 user %q must be at most 255 bytes", user)
+		}
+	}
+	return nil
+}
+
+// read the greeting message of socks5 client from r, select the authentication method from its methods,
+// and reply the method selected on conn.
+// If username/password authentication is required, the sub-negotiation is performed.
+func (c Credentials) negotiate(conn net.Conn, r io.Reader) error {
+	/**
+	  +----+----------+----------+
+	  |VER | NMETHODS | METHODS  |
+	  +----+----------+----------+
+	  | 1  |    1     | 1 to 255 |
+	  +----+----------+----------+
+	*/
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return err
+	}
+	if head[0] != 0x05 || head[1] == 0 {
+		return errors.New("bad socks5 greeting message")
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return err
+	}
+
+	if len(c) == 0 {
+		_, err := conn.Write([]byte{0x05, socks5MethodNoAuth}) // version and no authentication required
+		return err
+	}
+	if bytes.IndexByte(methods, socks5MethodUserPass) < 0 {
+		_, _ = conn.Write([]byte{0x05, socks5MethodNoAcceptable})
+		return errors.New("socks5 client does not support username/password authentication")
+	}
+	if _, err := conn.Write([]byte{0x05, socks5MethodUserPass}); err != nil {
+		return err
+	}
+
+	/**
+	  +----+------+----------+------+----------+
+	  |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+	  +----+------+----------+------+----------+
+	  | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+	  +----+------+----------+------+----------+
+	*/
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return err
+	}
+	if head[0] != 0x01 {
+		return fmt.Errorf("unsupported version of socks5 username/password authentication: %d", head[0])
+	}
+	user := make([]byte, int(head[1])+1) // with PLEN
+	if _, err := io.ReadFull(r, user); err != nil {
+		return err
+	}
+	pass := make([]byte, int(user[len(user)-1]))
+	if _, err := io.ReadFull(r, pass); err != nil {
+		return err
+	}
+
+	if !c.verify(string(user[:len(user)-1]), string(pass)) {
+		_, _ = conn.Write([]byte{0x01, 0x01})
+		return fmt.Errorf("socks5 authentication failed for user %q", user[:len(user)-1])
+	}
+	_, err := conn.Write([]byte{0x01, 0x00}) // success
+	return err
+}
@@ -0,0 +1,70 @@
+package wss
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// run the negotiation on server side of a pipe, and return the replies read by client side.
+func negotiateSocks5(t *testing.T, credentials Credentials, greeting, request []byte, replySize int) ([]byte, error) {
+	server, client := net.Pipe()
+	defer client.Close()
+	result := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		result <- credentials.negotiate(server, io.MultiReader(bytes.NewReader(greeting), server))
+	}()
+
+	reply := make([]byte, replySize)
+	if _, err := io.ReadFull(client, reply[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if request != nil {
+		if _, err := client.Write(request); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(client, reply[2:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return reply, <-result
+}
+
+func TestSocks5Auth(t *testing.T) {
+	credentials := make(Credentials)
+	if err := credentials.Add("alice:se:cret"); err != nil {
+		t.Fatal(err)
+	}
+	if credentials["alice"] != "se:cret" {
+		t.Fatalf("unexpected credentials %v", credentials)
+	}
+	if err := credentials.CheckSocks5(); err != nil {
+		t.Fatal(err)
+	}
+	long := Credentials{"bob": strings.Repeat("x", 256)} // accepted by http Basic authentication
+	if err := long.CheckSocks5(); err == nil {
+		t.Error("password longer than 255 bytes is accepted by socks5")
+	}
+	auth := append([]byte{0x01, 5}, "alice"...)
+	auth = append(auth, 7)
+
+	reply, err := negotiateSocks5(t, credentials, []byte{0x05, 0x02, 0x00, 0x02}, append(auth, "se:cret"...), 4)
+	if err != nil || !bytes.Equal(reply, []byte{0x05, 0x02, 0x01, 0x00}) {
+		t.Errorf("authentication should succeed, but got reply %v, %v", reply, err)
+	}
+	reply, err = negotiateSocks5(t, credentials, []byte{0x05, 0x02, 0x00, 0x02}, append(auth, "se:cre7"...), 4)
+	if err == nil || !bytes.Equal(reply, []byte{0x05, 0x02, 0x01, 0x01}) {
+		t.Errorf("authentication should fail, but got reply %v, %v", reply, err)
+	}
+	reply, err = negotiateSocks5(t, credentials, []byte{0x05, 0x01, 0x00}, nil, 2)
+	if err == nil || !bytes.Equal(reply, []byte{0x05, 0xFF}) {
+		t.Errorf("client without authentication should be rejected, but got reply %v, %v", reply, err)
+	}
+	reply, err = negotiateSocks5(t, nil, []byte{0x05, 0x01, 0x00}, nil, 2)
+	if err != nil || !bytes.Equal(reply, []byte{0x05, 0x00}) {
+		t.Errorf("no authentication is required, but got reply %v, %v", reply, err)
+	}
+}
@@ -0,0 +1,249 @@
+package wss
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/segmentio/ksuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// socks5 UDP ASSOCIATE (feature FeatureUdpAssociate):
+// client relays the datagrams of proxy client application by a local UDP socket,
+// and sends them to server in WsTpDatagram frames, where they are relayed by a UDP socket of the association.
+// The datagram in the frames is:
+//
+//	+------+----------+----------+----------+
+//	| ATYP | DST.ADDR | DST.PORT |   DATA   |
+//	+------+----------+----------+----------+
+//	|  1   | Variable |    2     | Variable |
+//	+------+----------+----------+----------+
+//
+// which is the socks5 UDP request header without the RSV and FRAG fields (see rfc 1928, section 7).
+// From client to server, the address is the destination of the datagram,
+// and from server to client, it is the source of the datagram.
+// The association lasts until the TCP connection of the UDP ASSOCIATE request is closed,
+// or it is expired on server after idle timeout.
+
+// the max size of a udp datagram.
+const maxDatagramSize = 64 * 1024
+
+// socks5 commands
+const (
+	socks5CmdConnect      = 0x01
+	socks5CmdBind         = 0x02
+	socks5CmdUdpAssociate = 0x03
+	socks5CmdResolve      = 0xF0 // tor extension, resolve a host name
+	socks5CmdResolvePtr   = 0xF1 // tor extension, reverse lookup of an ip address
+)
+
+// socks5 address types
+const (
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+)
+
+var errBadSocks5Addr = errors.New("bad socks5 address")
+
+// read the socks5 address (ATYP, DST.ADDR and DST.PORT) from r, returns host and port.
+// errBadSocks5Addr is returned if the address type is unknown or the domain is empty.
+func readSocks5Addr(r io.Reader) (string, int, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", 0, err
+	}
+	var addr []byte // DST.ADDR and DST.PORT
+	switch atyp[0] {
+	case socks5AddrIPv4:
+		addr = make([]byte, net.IPv4len+2)
+	case socks5AddrIPv6:
+		addr = make([]byte, net.IPv6len+2)
+	case socks5AddrDomain:
+		var size [1]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return "", 0, err
+		}
+		if size[0] == 0 {
+			return "", 0, errBadSocks5Addr
+		}
+		addr = make([]byte, int(size[0])+2)
+	default:
+		return "", 0, errBadSocks5Addr
+	}
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", 0, err
+	}
+
+	host := string(addr[:len(addr)-2])
+	if atyp[0] != socks5AddrDomain {
+		host = net.IP(addr[:len(addr)-2]).String()
+	}
+	return host, int(binary.BigEndian.Uint16(addr[len(addr)-2:])), nil
+}
+
+// parse the socks5 address at the beginning of b, returns host, port and the rest bytes after the address.
+func parseSocks5Addr(b []byte) (string, int, []byte, error) {
+	r := bytes.NewReader(b)
+	host, port, err := readSocks5Addr(r)
+	if err != nil {
+		return "", 0, nil, errBadSocks5Addr
+	}
+	return host, port, b[len(b)-r.Len():], nil
+}
+
+// append the socks5 address of ip and port to b. A nil ip is encoded as 0.0.0.0.
+func appendSocks5Addr(b []byte, ip net.IP, port int) []byte {
+	if ip4 := ip.To4(); ip4 != nil || ip == nil {
+		if ip4 == nil {
+			ip4 = net.IPv4zero.To4()
+		}
+		b = append(b, socks5AddrIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5AddrIPv6)
+		b = append(b, ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// write socks5 reply with reply code rep and the bound address.
+func writeSocks5Reply(w io.Writer, rep byte, ip net.IP, port int) error {
+	_, err := w.Write(appendSocks5Addr([]byte{0x05, rep, 0x00}, ip, port))
+	return err
+}
+
+// serve a socks5 UDP ASSOCIATE request from conn.
+// It returns after conn is closed by proxy client application, or the association is closed by server.
+func (client *Client) transDatagrams(wsc *WebSocketClient, conn *net.TCPConn, addr string) error {
+	if !wsc.HasFeature(FeatureUdpAssociate) {
+		_ = writeSocks5Reply(conn, 0x07, nil, 0) // command not supported
+		return errors.New("socks5 udp associate is not supported by server")
+	}
+
+	// the relay listens on the same address as the tcp listener.
+	local := conn.LocalAddr().(*net.TCPAddr)
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		_ = writeSocks5Reply(conn, 0x01, nil, 0)
+		return err
+	}
+	defer relay.Close()
+
+	type Done struct {
+		tell bool
+		err  error
+	}
+	done := make(chan Done, 4)
+	finish := func(d Done) {
+		select {
+		case done <- d:
+		default:
+		}
+	}
+	established := make(chan struct{}, 1)
+
+	// address of proxy client application, it is known after receiving its first datagram.
+	var appMu sync.RWMutex
+	var appAddr *net.UDPAddr
+
+	proxy := wsc.NewProxy(func(id ksuid.KSUID, data ServerData) {
+		switch data.Tag {
+		case TagEstOk:
+			established <- struct{}{}
+			return
+		case TagEstErr:
+			finish(Done{tell: false, err: errors.New("server failed to create udp association")})
+			return
+		}
+		appMu.RLock()
+		to := appAddr
+		appMu.RUnlock()
+		if to == nil {
+			return
+		}
+		packet := make([]byte, 0, 3+len(data.Data))
+		packet = append(append(packet, 0x00, 0x00, 0x00), data.Data...) // RSV and FRAG
+		_, _ = relay.WriteToUDP(packet, to)
+	}, func(id ksuid.KSUID, tell bool) {
+		finish(Done{tell: tell})
+	}, func(id ksuid.KSUID, err error) {
+		var estErr *ProxyEstError
+		if errors.As(err, &estErr) {
+			_ = writeSocks5EstError(conn, estErr)
+			finish(Done{tell: false, err: err})
+			return
+		}
+		finish(Done{tell: true, err: err})
+	})
+
+	if err := proxy.Establish(wsc, nil, ProxyTypeSocks5Udp, addr); err != nil {
+		wsc.RemoveProxy(proxy.Id)
+		_ = writeSocks5Reply(conn, 0x01, nil, 0)
+		return err
+	}
+
+	select {
+	case <-established:
+	case d := <-done:
+		wsc.RemoveProxy(proxy.Id)
+		return d.err
+	}
+	bound := relay.LocalAddr().(*net.UDPAddr)
+	if err := writeSocks5Reply(conn, 0x00, bound.IP, bound.Port); err != nil {
+		wsc.RemoveProxy(proxy.Id)
+		_ = wsc.TellClose(proxy.Id)
+		return err
+	}
+	log.WithField("address", bound.String()).Debug("socks5 udp association is created.")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// datagrams from proxy client application
+	go func() {
+		appIP := conn.RemoteAddr().(*net.TCPAddr).IP
+		buffer := make([]byte, maxDatagramSize)
+		for {
+			n, from, err := relay.ReadFromUDP(buffer)
+			if err != nil {
+				finish(Done{tell: true, err: err})
+				return
+			}
+			// only datagrams from the host of proxy client application are accepted,
+			// and fragmented datagrams are dropped.
+			if !from.IP.Equal(appIP) || n < 4 || buffer[2] != 0x00 {
+				continue
+			}
+			if _, _, _, err := parseSocks5Addr(buffer[3:n]); err != nil {
+				continue
+			}
+			appMu.Lock()
+			appAddr = from
+			appMu.Unlock()
+			if err := wsc.WriteDatagram(ctx, proxy.Id, buffer[3:n]); err != nil {
+				finish(Done{tell: true, err: err})
+				return
+			}
+		}
+	}()
+	// the association is closed when the tcp connection is closed.
+	go func() {
+		_, err := io.Copy(ioutil.Discard, conn)
+		finish(Done{tell: true, err: err})
+	}()
+
+	d := <-done
+	wsc.RemoveProxy(proxy.Id)
+	if d.tell {
+		if err := wsc.TellClose(proxy.Id); err != nil {
+			return err
+		}
+	}
+	return d.err
+}
@@ -27,9 +27,11 @@ type Info struct {
 }
 
 type Statistics struct {
-	UpTime  float64 `json:"up_time"`
-	Clients int     `json:"clients"`
-	Proxies int     `json:"proxies"`
+	UpTime           float64              `json:"up_time"`
+	Clients          int                  `json:"clients"`
+	Proxies          int                  `json:"proxies"`
+	Compression      wss.CompressionStats `json:"compression"`
+	CompressionRatio float64              `json:"compression_ratio"` // wire bytes / raw bytes of data
 }
 
 type Status struct {
@@ -62,6 +64,7 @@ func (s *handleStatus) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	clients, proxies := s.hc.GetConnCount()
+	compression := s.hc.CompressionStats()
 	duration := time.Now().Sub(s.setupTime).Truncate(time.Second)
 
 	status := Status{
@@ -80,9 +83,11 @@ func (s *handleStatus) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			SSLDisableReason:    "not support", // todo ssl support
 		},
 		Statistics: Statistics{
-			UpTime:  duration.Seconds(),
-			Clients: clients,
-			Proxies: proxies,
+			UpTime:           duration.Seconds(),
+			Clients:          clients,
+			Proxies:          proxies,
+			Compression:      compression,
+			CompressionRatio: compression.Ratio(),
 		},
 	}
 
@@ -6,6 +6,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ssh/terminal"
 	"os"
+	"strings"
 	"text/tabwriter"
 )
 
@@ -40,6 +41,16 @@ func (p *ProgressLog) SetLogBuffer(r *wss.ConnRecord) {
 	_, _ = fmt.Fprintf(w, "TARGETs\tCONNECTIONs\t\n")
 	terminalRows--
 
+	// distribution of connections on websockets
+	if r.Streams != nil && terminalRows > 2 {
+		var dist strings.Builder
+		for i, size := range r.Streams() {
+			_, _ = fmt.Fprintf(&dist, "#%d: %d  ", i, size)
+		}
+		_, _ = fmt.Fprintf(w, "WEBSOCKETs\t%s\t\n", strings.TrimSpace(dist.String()))
+		terminalRows--
+	}
+
 	var recordsHiden = len(r.Addresses)
 	if terminalRows >= 2 { // at least 2 lines left: one for show more records and one for new line(\n).
 		// have rows left
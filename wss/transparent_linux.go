@@ -0,0 +1,91 @@
+//go:build linux
+// +build linux
+
+package wss
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// socket options of linux, see linux/netfilter_ipv4.h, linux/in.h and linux/in6.h.
+const (
+	soOriginalDst   = 80 // SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST
+	ipTransparent   = 19 // IP_TRANSPARENT
+	ipv6Transparent = 75 // IPV6_TRANSPARENT
+)
+
+// listen on address for the redirected connections.
+// IP_TRANSPARENT is set if possible, which is required by TPROXY rules (and CAP_NET_ADMIN is needed for it).
+func listenTransparent(address string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, ipTransparent, 1)
+			if network == "tcp6" {
+				if err := syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6Transparent, 1); err != nil {
+					sockErr = err
+				}
+			}
+		}); err != nil {
+			return err
+		}
+		if sockErr != nil {
+			log.WithField("error", sockErr).Debug("IP_TRANSPARENT is not set, only REDIRECT rules are supported by the transparent proxy.")
+		}
+		return nil
+	}}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+// the destination of conn before it is redirected.
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("not a tcp connection")
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var dst *net.TCPAddr
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			// the address is a struct sockaddr_in, which fits in the struct ip_mreqn.
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			sa := mreq.Multiaddr
+			dst = &net.TCPAddr{IP: net.IPv4(sa[4], sa[5], sa[6], sa[7]), Port: int(sa[2])<<8 | int(sa[3])}
+			return
+		}
+		// the address is a struct sockaddr_in6, which fits in the struct ip6_mtuinfo.
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port)) // in network byte order
+		dst = &net.TCPAddr{IP: append(net.IP(nil), info.Addr.Addr[:]...), Port: int(port[0])<<8 | int(port[1]), Zone: local.Zone}
+	}); err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		// no NAT record of the connection, e.g. it is redirected by TPROXY or conntrack is not loaded,
+		// then the local address is the original destination.
+		if sockErr == syscall.ENOENT || sockErr == syscall.ENOPROTOOPT {
+			return local, nil
+		}
+		return nil, os.NewSyscallError("getsockopt", sockErr)
+	}
+	return dst, nil
+}
@@ -0,0 +1,38 @@
+package wss
+
+import (
+	"net"
+	"testing"
+)
+
+func TestOriginalDst(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:0", "[::1]:0"} {
+		l, err := listenTransparent(address)
+		if err != nil {
+			t.Log("skip ", address, ": ", err)
+			continue
+		}
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the connection is not redirected, its original destination is the listener itself.
+		dst, err := originalDst(conn.(*net.TCPConn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dst.String() != l.Addr().String() {
+			t.Errorf("original destination of %s is %s", l.Addr(), dst)
+		}
+		if _, err := transparentTarget(conn.(*net.TCPConn), l.Addr().(*net.TCPAddr)); err == nil {
+			t.Error("connection to listener itself is accepted")
+		}
+		c.Close()
+		conn.Close()
+		l.Close()
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package wss
+
+import "net"
+
+func listenTransparent(address string) (net.Listener, error) {
+	return nil, ErrTransparentNotSupported
+}
+
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, ErrTransparentNotSupported
+}
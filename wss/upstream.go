@@ -0,0 +1,56 @@
+package wss
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// UpstreamConfig is the policy of connecting to proxy targets on server.
+// The dialer is shared by socks5/https(CONNECT) proxy and the transport of http proxy.
+type UpstreamConfig struct {
+	DialTimeout           time.Duration // timeout of connecting to a target
+	KeepAlive             time.Duration // tcp keep-alive period of connections to targets, negative for disabling it
+	TLSHandshakeTimeout   time.Duration // timeout of tls handshake of http proxy (for https urls)
+	ResponseHeaderTimeout time.Duration // time to wait for the response header of http proxy, 0 for no timeout
+	IdleConnTimeout       time.Duration // time to keep an idle connection of http proxy in pool
+	MaxIdleConns          int           // max idle connections of http proxy in pool, 0 for no limit
+	MaxIdleConnsPerHost   int           // max idle connections of http proxy per host in pool
+	EnableHTTP2           bool          // try HTTP/2 for https urls of http proxy
+	ProxyFromEnvironment  bool          // send http proxy requests via the proxy in HTTP_PROXY/NO_PROXY environment variables
+}
+
+// DefaultUpstreamConfig is used if WebsocksServerConfig does not give the dialer or transport.
+var DefaultUpstreamConfig = UpstreamConfig{
+	DialTimeout:         8 * time.Second,
+	KeepAlive:           30 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+	IdleConnTimeout:     90 * time.Second,
+	MaxIdleConns:        100,
+	MaxIdleConnsPerHost: 16,
+	EnableHTTP2:         true,
+}
+
+// Dialer returns the dialer connecting to targets.
+func (c UpstreamConfig) Dialer() *net.Dialer {
+	return &net.Dialer{Timeout: c.DialTimeout, KeepAlive: c.KeepAlive}
+}
+
+// Transport returns a new transport for http proxy, which connects to targets by the dialer of c.
+func (c UpstreamConfig) Transport() *http.Transport {
+	t := &http.Transport{
+		DialContext:           c.Dialer().DialContext,
+		TLSHandshakeTimeout:   c.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: c.ResponseHeaderTimeout,
+		IdleConnTimeout:       c.IdleConnTimeout,
+		MaxIdleConns:          c.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+		ForceAttemptHTTP2:     c.EnableHTTP2,
+		ExpectContinueTimeout: time.Second,
+		DisableCompression:    true, // Accept-Encoding is decided by proxy client
+	}
+	if c.ProxyFromEnvironment {
+		t.Proxy = http.ProxyFromEnvironment
+	}
+	return t
+}
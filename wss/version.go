@@ -2,50 +2,181 @@ package wss
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
 	"nhooyr.io/websocket"
 	"nhooyr.io/websocket/wsjson"
 )
 
 // version of protocol.
-const VersionCode = 0x004
+const VersionCode = 0x005
 const CompVersion = 0x003
 const CoreVersion = "0.6.0"
 
+var ErrIncompatibleVersion = errors.New("incompatible protocol version of client and server")
+
 type VersionNeg struct {
-	Version          string `json:"version"`
-	CompVersion      uint   `json:"comp_version"` // Compatible version code
-	VersionCode      uint   `json:"version_code"`
-	EnableStatusPage bool   `json:"status_page"`
+	Version          string   `json:"version"`
+	CompVersion      uint     `json:"comp_version"` // Compatible version code
+	VersionCode      uint     `json:"version_code"`
+	EnableStatusPage bool     `json:"status_page"`
+	Features         []string `json:"features"`    // supported features, nil if the peer is older than version code 0x005
+	RecvWindow       uint32   `json:"recv_window"` // receive window of each stream for flow control
+	SessionId        string   `json:"session_id"`  // session token assigned by server, or the session to be resumed by client
+	Resumed          bool     `json:"resumed"`     // the session is resumed by server
+	RecvSeq          uint64   `json:"recv_seq"`    // count of frames received in the resumed session
 }
 
 // negotiate client and server version
 // after websocket connection is established,
 // client can receive a message from server with server version number.
-func ExchangeVersion(ctx context.Context, wsConn *websocket.Conn) (VersionNeg, error) {
+// Client advertises its features, and the features supported by both sides are used on the websocket.
+// If wsc is prepared to resume a session (see WebSocketClient.ResumeFrom), it asks server to resume the session.
+// If compression is set on wsc (see ConcurrentWebSocket.SetCompression), it asks server for compression,
+// and compression is disabled if server does not accept it.
+func ExchangeVersion(ctx context.Context, wsc *ConcurrentWebSocket) (VersionNeg, error) {
 	var versionRec VersionNeg
-	versionServer := VersionNeg{Version: CoreVersion, VersionCode: VersionCode}
-	if err := wsjson.Write(ctx, wsConn, &versionServer); err != nil {
+	features := []string{FeatureHttpProxy, FeatureBinaryFrame, FeatureFlowControl, FeatureResume, FeatureHalfClose, FeatureUdpAssociate, FeatureSocks5Bind, FeatureSocks4, FeatureResolve, FeatureHttpKeepAlive, FeatureHttpUpgrade, FeatureTransparent, FeatureForward}
+	if wsc.Compression() == CompressionFlate {
+		features = append(features, FeatureCompressFlate)
+	}
+	versionClient := VersionNeg{Version: CoreVersion, CompVersion: CompVersion, VersionCode: VersionCode,
+		Features: features, RecvWindow: DefaultStreamWindow}
+	if wsc.session != nil {
+		versionClient.SessionId = wsc.session.id
+		versionClient.RecvSeq = wsc.session.received()
+	}
+	if err := wsjson.Write(ctx, wsc.conn(), &versionClient); err != nil {
 		return versionRec, err
 	}
-	if err := wsjson.Read(ctx, wsConn, &versionRec); err != nil {
+	if err := wsjson.Read(ctx, wsc.conn(), &versionRec); err != nil {
 		return versionRec, err
 	}
+	// old server never advertises features, thus json message is still used.
+	wsc.features = IntersectFeatures(features, versionRec.Features)
+	wsc.SetBinaryFrame(wsc.HasFeature(FeatureBinaryFrame))
+	if wsc.HasFeature(FeatureFlowControl) {
+		wsc.SetPeerWindow(versionRec.RecvWindow)
+	}
+	if !wsc.HasFeature(FeatureCompressFlate) || !wsc.IsBinaryFrame() {
+		wsc.SetCompression("", 0) // compression is only available on binary frame.
+	}
+
+	if versionRec.Resumed && wsc.session != nil && wsc.session.id == versionRec.SessionId {
+		wsc.resumed = true
+		wsc.resumeSeq = versionRec.RecvSeq
+	} else if versionRec.SessionId != "" {
+		wsc.session = newSession(versionRec.SessionId)
+	} else {
+		wsc.session = nil
+	}
 	return versionRec, nil
 }
 
-// send version information to client from server
-func NegVersionServer(ctx context.Context, wsConn *websocket.Conn, enableStatusPage bool) error {
+// features provided by server with the config.
+func serverFeatures(config WebsocksServerConfig) []string {
+	features := []string{FeatureBinaryFrame, FeatureFlowControl, FeatureHalfClose, FeatureUdpAssociate, FeatureSocks4, FeatureResolve, FeatureTransparent, FeatureForward}
+	if config.EnableHttp {
+		features = append(features, FeatureHttpProxy, FeatureHttpKeepAlive, FeatureHttpUpgrade)
+	}
+	if config.EnableBind {
+		features = append(features, FeatureSocks5Bind)
+	}
+	if config.SessionGrace > 0 {
+		features = append(features, FeatureResume)
+	}
+	if config.EnableCompression {
+		features = append(features, FeatureCompressFlate)
+	}
+	return features
+}
+
+// read version information from client, and send server version back to client.
+// Client with incompatible version is rejected, and the websocket is closed with the reason.
+// It returns the hub to serve the client: if the client resumes a session kept in hc,
+// the hub of the session is reattached to the new websocket connection,
+// otherwise a new hub is created.
+// The returned hub is locked for reading (Hub.readMu), and it must be unlocked after reading is finished.
+func NegVersionServer(ctx context.Context, wc *websocket.Conn, config WebsocksServerConfig, hc *HubCollection) (*Hub, error) {
 	// read from client
 	var versionClient VersionNeg
-	if err := wsjson.Read(ctx, wsConn, &versionClient); err != nil {
-		return err
+	if err := wsjson.Read(ctx, wc, &versionClient); err != nil {
+		return nil, err
+	}
+	if !IsCompatible(versionClient) {
+		reason := fmt.Sprintf("incompatible version: client %#x (compatible %#x), server %#x (compatible %#x)",
+			versionClient.VersionCode, versionClient.CompVersion, VersionCode, CompVersion)
+		log.WithField("client version", versionClient.Version).Warning(reason)
+		_ = wc.Close(websocket.StatusPolicyViolation, reason)
+		return nil, ErrIncompatibleVersion
+	}
+
+	features := serverFeatures(config)
+	var hub *Hub = nil
+	if versionClient.SessionId != "" {
+		hub = hc.attach(versionClient.SessionId)
+	}
+	resumed := hub != nil
+	if !resumed {
+		hub = hc.NewHub(wc)
+		hub.readMu.Lock()
+		hub.features = IntersectFeatures(features, versionClient.Features)
+		hub.SetBinaryFrame(hub.HasFeature(FeatureBinaryFrame)) // use binary frame only if client supports it.
+		if hub.HasFeature(FeatureFlowControl) {
+			hub.SetPeerWindow(versionClient.RecvWindow)
+		}
+		// session resuming depends on flow control to limit the size of frames kept for resending.
+		if hub.HasFeature(FeatureResume) && hub.FlowControlEnabled() {
+			if id, err := newSessionId(); err != nil {
+				log.Error("generate session id error: ", err)
+			} else {
+				hub.session = newSession(id)
+				hc.addSession(hub)
+			}
+		}
+		if hub.HasFeature(FeatureCompressFlate) && hub.IsBinaryFrame() {
+			hub.SetCompression(CompressionFlate, config.CompressThreshold)
+		}
 	}
+
 	// send to client
 	versionServer := VersionNeg{
 		Version:          CoreVersion,
 		CompVersion:      CompVersion,
 		VersionCode:      VersionCode,
-		EnableStatusPage: enableStatusPage,
+		EnableStatusPage: config.EnableStatusPage,
+		Features:         features,
+		Resumed:          resumed,
 	} // todo more information
-	return wsjson.Write(ctx, wsConn, &versionServer)
+	if hub.FlowControlEnabled() { // enable flow control only if client supports it.
+		versionServer.RecvWindow = DefaultStreamWindow
+	}
+	if hub.session != nil {
+		versionServer.SessionId = hub.session.id
+		if resumed {
+			versionServer.RecvSeq = hub.session.received()
+		}
+	}
+	if err := wsjson.Write(ctx, wc, &versionServer); err != nil {
+		hub.readMu.Unlock()
+		hc.OnDisconnected(hub, hc.Generation(hub), config.SessionGrace)
+		return nil, err
+	}
+	if resumed {
+		// switch to the new connection, and resend frames not received by client.
+		if err := hub.session.resume(&hub.ConcurrentWebSocket, wc, versionClient.RecvSeq); err != nil {
+			hub.readMu.Unlock()
+			hc.OnDisconnected(hub, hc.Generation(hub), config.SessionGrace)
+			return nil, err
+		}
+	}
+	return hub, nil
+}
+
+// IsCompatible checks whether a peer with the given version information can talk with us.
+// The peer's compatible version must not be newer than our version,
+// and our compatible version must not be newer than the peer's version.
+func IsCompatible(peer VersionNeg) bool {
+	return peer.CompVersion <= VersionCode && CompVersion <= peer.VersionCode
 }
@@ -0,0 +1,48 @@
+package wss
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestIntersectFeatures(t *testing.T) {
+	ours := []string{FeatureHttpProxy, FeatureBinaryFrame, FeatureCompressFlate}
+	if common := IntersectFeatures(ours, []string{FeatureCompressFlate, FeatureResume, FeatureHttpProxy}); !reflect.DeepEqual(common, []string{FeatureHttpProxy, FeatureCompressFlate}) {
+		t.Errorf("unexpected common features: %v", common)
+	}
+	if common := IntersectFeatures(ours, nil); common != nil {
+		t.Errorf("features of old peer should be nil, but got %v", common)
+	}
+}
+
+func TestRejectIncompatibleClient(t *testing.T) {
+	server := httptest.NewServer(NewServeWS(NewHubCollection(), WebsocksServerConfig{}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(websocket.StatusNormalClosure, "")
+
+	if err := wsjson.Write(ctx, conn, VersionNeg{Version: "0.1.0", VersionCode: 0x001, CompVersion: 0x001}); err != nil {
+		t.Fatal(err)
+	}
+	var version VersionNeg
+	err = wsjson.Read(ctx, conn, &version)
+	if websocket.CloseStatus(err) != websocket.StatusPolicyViolation {
+		t.Fatalf("expect the connection closed for policy violation, but got %v", err)
+	}
+	if !strings.Contains(err.Error(), "incompatible version") {
+		t.Errorf("close reason should tell the incompatible version, but got %v", err)
+	}
+}
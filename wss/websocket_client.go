@@ -2,12 +2,10 @@ package wss
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"github.com/segmentio/ksuid"
 	"net/http"
 	"nhooyr.io/websocket"
-	"nhooyr.io/websocket/wsjson"
 	"sync"
 	"time"
 )
@@ -20,6 +18,18 @@ type WebSocketClient struct {
 	proxies map[ksuid.KSUID]*ProxyClient // all proxies on this websocket.
 	proxyMu sync.RWMutex                 // mutex to operate proxies map.
 	cancel  context.CancelFunc
+	// resolve requests waiting for responses from server.
+	resolves resolveRequests
+}
+
+// WebSocketClientPicker picks a websocket connection for a new proxy connection.
+type WebSocketClientPicker interface {
+	Pick() (*WebSocketClient, error)
+}
+
+// Pick implements WebSocketClientPicker, it always returns the websocket client itself.
+func (wsc *WebSocketClient) Pick() (*WebSocketClient, error) {
+	return wsc, nil
 }
 
 // get the connection size
@@ -48,8 +58,14 @@ func NewWebSocketClient(ctx context.Context, addr string, hc *http.Client, heade
 // create a new proxy with unique id
 func (wsc *WebSocketClient) NewProxy(onData func(ksuid.KSUID, ServerData),
 	onClosed func(ksuid.KSUID, bool), onError func(ksuid.KSUID, error)) *ProxyClient {
-	id := ksuid.New()
-	proxy := ProxyClient{Id: id, onData: onData, onClosed: onClosed, onError: onError}
+	return wsc.newProxyWithId(ksuid.New(), onData, onClosed, onError)
+}
+
+// create a new proxy with the given id, so that the states used by the callbacks (e.g. flow receiver of the id)
+// can be created before the proxy is added, since the callbacks can be called from then on.
+func (wsc *WebSocketClient) newProxyWithId(id ksuid.KSUID, onData func(ksuid.KSUID, ServerData),
+	onClosed func(ksuid.KSUID, bool), onError func(ksuid.KSUID, error)) *ProxyClient {
+	proxy := ProxyClient{Id: id, onData: onData, onClosed: onClosed, onError: onError, window: wsc.newSendWindow()}
 
 	wsc.proxyMu.Lock()
 	defer wsc.proxyMu.Unlock()
@@ -70,14 +86,9 @@ func (wsc *WebSocketClient) GetProxyById(id ksuid.KSUID) *ProxyClient {
 // tell the remote proxy server to close this connection.
 func (wsc *WebSocketClient) TellClose(id ksuid.KSUID) error {
 	// send finish flag to client
-	finish := WebSocketMessage{
-		Id:   id.String(),
-		Type: WsTpClose,
-		Data: nil,
-	}
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
-	if err := wsjson.Write(ctx, wsc.WsConn, &finish); err != nil {
+	if err := wsc.WriteMessage(ctx, id, WsTpClose, nil); err != nil {
 		return err
 	}
 	return nil
@@ -87,16 +98,24 @@ func (wsc *WebSocketClient) TellClose(id ksuid.KSUID) error {
 func (wsc *WebSocketClient) RemoveProxy(id ksuid.KSUID) {
 	wsc.proxyMu.Lock()
 	defer wsc.proxyMu.Unlock()
-	if _, ok := wsc.proxies[id]; ok {
+	if proxy, ok := wsc.proxies[id]; ok {
+		proxy.window.close() // wake up the blocked writer
 		delete(wsc.proxies, id)
 	}
 }
 
+// create a writer to send data of proxy to the proxy server.
+// The writer is blocked if the send window of proxy is used up.
+func (wsc *WebSocketClient) NewProxyWriter(proxy *ProxyClient, ctx context.Context) *webSocketWriter {
+	return NewWebSocketWriterWithMutex(&wsc.ConcurrentWebSocket, proxy.Id, ctx).WithWindow(proxy.window)
+}
+
 // listen income websocket messages and dispatch to different proxies.
 func (wsc *WebSocketClient) ListenIncomeMsg(readLimit int64) error {
 	ctx, can := context.WithCancel(context.Background())
 	wsc.cancel = can
-	wsc.WsConn.SetReadLimit(readLimit)
+	conn := wsc.conn()
+	conn.SetReadLimit(readLimit)
 
 	for {
 		// check stop first
@@ -107,47 +126,93 @@ func (wsc *WebSocketClient) ListenIncomeMsg(readLimit int64) error {
 			// if the channel is still open, continue as normal
 		}
 
-		_, data, err := wsc.WsConn.Read(ctx)
+		msgType, data, err := conn.Read(ctx)
 		if err != nil {
-			// todo close all
+			// proxies of a resumable session are kept, they can be resumed on a new websocket connection.
+			if !wsc.Resumable() {
+				wsc.closeAllProxies()
+			}
 			return err // todo close websocket
 		}
 
-		var socketData json.RawMessage
-		socketStream := WebSocketMessage{
-			Data: &socketData,
+		frame, err := decodeFrame(msgType, data, wsc.compression != nil)
+		if err != nil {
+			continue // todo log
 		}
-		if err := json.Unmarshal(data, &socketStream); err != nil {
+		if err := wsc.onFrameReceived(frame); err != nil {
 			continue // todo log
 		}
-		// find proxy by id
-		if ksid, err := ksuid.Parse(socketStream.Id); err != nil {
+		if frame.Type == WsTpResolved {
+			_ = wsc.resolves.onResolved(frame)
 			continue
-		} else {
-			if proxy := wsc.GetProxyById(ksid); proxy != nil {
-				// now, we known the id and type of incoming data
-				switch socketStream.Type {
-				case WsTpClose: // remove proxy
-					proxy.onClosed(ksid, false)
-				case WsTpData:
-					var proxyData ProxyData
-					if err := json.Unmarshal(socketData, &proxyData); err != nil {
-						proxy.onError(ksid, err)
-						continue
-					}
-					if decodeBytes, err := base64.StdEncoding.DecodeString(proxyData.DataBase64); err != nil {
-						proxy.onError(ksid, err)
-						continue
-					} else {
-						// just write data back
-						proxy.onData(ksid, ServerData{Tag: proxyData.Tag, Data: decodeBytes})
-					}
+		}
+		// find proxy by id
+		if proxy := wsc.GetProxyById(frame.Id); proxy != nil {
+			// now, we known the id and type of incoming data
+			switch frame.Type {
+			case WsTpClose: // remove proxy
+				// the close message may carry the reason of failing to establish the connection.
+				var estErr ProxyEstError
+				if len(frame.Body) > 0 && json.Unmarshal(frame.Body, &estErr) == nil && estErr.Code != 0 {
+					proxy.onError(frame.Id, &estErr)
+				}
+				proxy.onClosed(frame.Id, false)
+			case WsTpData:
+				// just write data back
+				proxy.onData(frame.Id, ServerData{Tag: frame.Tag, Data: frame.Data})
+			case WsTpDatagram:
+				proxy.onData(frame.Id, ServerData{Tag: TagData, Data: frame.Data})
+			case WsTpWindow:
+				var window ProxyWindow
+				if err := json.Unmarshal(frame.Body, &window); err != nil {
+					proxy.onError(frame.Id, err)
+					continue
 				}
+				proxy.window.onUpdate(window.Consumed)
 			}
 		}
 	}
 }
 
+// ResumeFrom prepares wsc (a newly dialed websocket connection) for resuming the session of prev.
+// It should be called before version negotiation, and after negotiation,
+// if Resumed returns true, the proxies of prev can be moved to wsc by calling prev.Reattach(wsc).
+func (wsc *WebSocketClient) ResumeFrom(prev *WebSocketClient) {
+	wsc.session = prev.session
+}
+
+// Resumed returns true if the session is resumed by server in version negotiation.
+func (wsc *WebSocketClient) Resumed() bool {
+	return wsc.resumed
+}
+
+// Reattach switches the session of wsc to the websocket connection of next,
+// and resends the frames not received by server.
+// next must be resumed from wsc, and it should not be used anymore after reattaching.
+func (wsc *WebSocketClient) Reattach(next *WebSocketClient) error {
+	return wsc.session.resume(&wsc.ConcurrentWebSocket, next.conn(), next.resumeSeq)
+}
+
+// CloseAllProxies closes all proxies on this websocket,
+// it is used if the session can not be resumed after the websocket connection is lost.
+func (wsc *WebSocketClient) CloseAllProxies() {
+	wsc.closeAllProxies()
+}
+
+// close all proxies on this websocket, as the websocket connection is lost.
+func (wsc *WebSocketClient) closeAllProxies() {
+	wsc.proxyMu.RLock()
+	proxies := make([]*ProxyClient, 0, len(wsc.proxies))
+	for _, proxy := range wsc.proxies {
+		proxies = append(proxies, proxy)
+	}
+	wsc.proxyMu.RUnlock()
+
+	for _, proxy := range proxies {
+		proxy.onClosed(proxy.Id, false)
+	}
+}
+
 func (wsc *WebSocketClient) Close() error {
 	if wsc.cancel != nil {
 		wsc.cancel()
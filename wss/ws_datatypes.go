@@ -8,11 +8,16 @@ import (
 )
 
 const (
-	WsTpVer   = "version"
-	WsTpBeats = "heart_beat"
-	WsTpClose = "finish"
-	WsTpData  = "data"
-	WsTpEst   = "est" // establish
+	WsTpVer      = "version"
+	WsTpBeats    = "heart_beat"
+	WsTpClose    = "finish"
+	WsTpData     = "data"
+	WsTpEst      = "est"      // establish
+	WsTpWindow   = "window"   // window update of flow control
+	WsTpAck      = "ack"      // ack of received frames in resumable session
+	WsTpDatagram = "datagram" // udp datagram of socks5 UDP ASSOCIATE
+	WsTpResolve  = "resolve"  // dns resolution request (client to server)
+	WsTpResolved = "resolved" // dns resolution response (server to client)
 )
 
 // write data to WebSocket server or client
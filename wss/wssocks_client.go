@@ -1,6 +1,8 @@
 package wss
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -8,17 +10,40 @@ import (
 	log "github.com/sirupsen/logrus"
 	"io"
 	"net"
+	"strconv"
 	"sync"
+	"time"
 )
 
 var StoppedError = errors.New("listener stopped")
 
+const (
+	headerTimeout = 30 * time.Second // time to receive the header of proxy protocol
+	maxHeaderSize = 64 * 1024        // max size of the header of proxy protocol
+)
+
+// server features required by proxy types, the proxy types not listed are supported by all servers.
+var proxyTypeFeatures = map[int]string{
+	ProxyTypeSocks5Bind: FeatureSocks5Bind,
+	ProxyTypeSocks4:     FeatureSocks4,
+
+	ProxyTypeSocks5Resolve:    FeatureResolve,
+	ProxyTypeSocks5ResolvePtr: FeatureResolve,
+	ProxyTypeTransparent:      FeatureTransparent,
+	ProxyTypeForward:          FeatureForward,
+}
+
 // client part of wssocks
 type Client struct {
 	tcpl    *net.TCPListener
+	udpl    *net.UDPConn // udp socket of udp port forwarding, used instead of tcpl
 	stop    chan interface{}
 	closed  bool
 	wgClose sync.WaitGroup // wait for closing
+	// credentials of socks5 username/password authentication, empty for no authentication.
+	socks5Credentials Credentials
+	httpCredentials   Credentials // Basic credentials of CONNECT requests
+	httpProxy         *HttpClient // serves plain http proxy requests, nil if they are not accepted
 }
 
 func NewClient() *Client {
@@ -28,43 +53,78 @@ func NewClient() *Client {
 	return &client
 }
 
-// parse target address and proxy type, and response to socks5/https client
+// SetSocks5Credentials requires socks5 clients to authenticate with one of the credentials.
+func (client *Client) SetSocks5Credentials(credentials Credentials) {
+	client.socks5Credentials = credentials
+}
+
+// SetHttpCredentials requires https (CONNECT) clients to authenticate with one of the credentials.
+func (client *Client) SetHttpCredentials(credentials Credentials) {
+	client.httpCredentials = credentials
+}
+
+// SetHttpProxy accepts plain http proxy requests on the listener (if http proxy is enabled), served by httpProxy.
+// Then socks5, https (CONNECT) and plain http proxy are all served on the same port.
+func (client *Client) SetHttpProxy(httpProxy *HttpClient) {
+	client.httpProxy = httpProxy
+}
+
+// parse target address and proxy type, and response to socks5/https client.
+// For plain http proxy requests, the proxy type is ProxyTypeHttp,
+// and the returned data is all the data received, to be served by HttpClient.
 func (client *Client) Reply(conn net.Conn, enableHttp bool) ([]byte, int, string, error) {
-	var buffer [1024]byte
 	var addr string
 	var proxyType int
 
-	n, err := conn.Read(buffer[:])
-	if err != nil {
+	// the header must be received in time, and its size is limited.
+	if err := conn.SetReadDeadline(time.Now().Add(headerTimeout)); err != nil {
 		return nil, 0, "", err
 	}
+	defer conn.SetReadDeadline(time.Time{})
+	reader := bufio.NewReader(io.LimitReader(conn, maxHeaderSize))
+
+	if _, err := reader.Peek(1); err != nil {
+		return nil, 0, "", err
+	}
+	received, _ := reader.Peek(reader.Buffered())
 
 	// select a matched proxy type
-	instances := []ProxyInterface{&Socks5Client{}}
+	instances := []ProxyInterface{&Socks5Client{credentials: client.socks5Credentials}, &Socks4Client{credentials: client.socks5Credentials}}
 	if enableHttp { // if http and https proxy is enabled.
-		instances = append(instances, &HttpsClient{})
+		instances = append(instances, &HttpsClient{credentials: client.httpCredentials})
+		if client.httpProxy != nil {
+			instances = append(instances, &HttpPlainClient{})
+		}
 	}
 	var matchedInstance ProxyInterface = nil
 	for _, proxyInstance := range instances {
-		if proxyInstance.Trigger(buffer[:n]) {
+		if proxyInstance.Trigger(received) {
 			matchedInstance = proxyInstance
 			break
 		}
 	}
 
 	if matchedInstance == nil {
-		return nil, 0, "", errors.New("only socks5 or http(s) proxy")
+		return nil, 0, "", errors.New("only socks5, socks4 or http(s) proxy")
 	}
 
 	// set address and type
-	if proxyAddr, err := matchedInstance.ParseHeader(conn, buffer[:n]); err != nil {
+	if proxyAddr, err := matchedInstance.ParseHeader(conn, reader); err != nil {
 		return nil, 0, "", err
+	} else if host, port, err := net.SplitHostPort(proxyAddr); err != nil || !validHost(host) || !validPort(port) {
+		return nil, 0, "", fmt.Errorf("bad target address %q", proxyAddr)
 	} else {
 		proxyType = matchedInstance.ProxyType()
 		addr = proxyAddr
 	}
+	// bytes received after the header.
+	var rest []byte
+	if n := reader.Buffered(); n > 0 {
+		buffered, _ := reader.Peek(n)
+		rest = append([]byte(nil), buffered...)
+	}
 	// set data sent in establish step.
-	if firstSendData, err := matchedInstance.EstablishData(buffer[:n]); err != nil {
+	if firstSendData, err := matchedInstance.EstablishData(rest); err != nil {
 		return nil, 0, "", err
 	} else {
 		// firstSendData can be nil, which means there is no data to be send during connection establishing.
@@ -72,8 +132,31 @@ func (client *Client) Reply(conn net.Conn, enableHttp bool) ([]byte, int, string
 	}
 }
 
+// check whether host is an ip or a host name,
+// to make sure the target address can not be misinterpreted on server.
+func validHost(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	if host == "" || len(host) > 255 {
+		return false
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func validPort(port string) bool {
+	p, err := strconv.ParseUint(port, 10, 16)
+	return err == nil && strconv.FormatUint(p, 10) == port
+}
+
 // listen on local address:port and forward socks5 requests to wssocks server.
-func (client *Client) ListenAndServe(record *ConnRecord, wsc *WebSocketClient, address string, enableHttp bool, onConnected func()) error {
+// For each proxy connection, the websocket connection to wssocks server is picked by picker.
+func (client *Client) ListenAndServe(record *ConnRecord, picker WebSocketClientPicker, address string, enableHttp bool, onConnected func()) error {
 	netListener, err := net.Listen("tcp", address)
 	if err != nil {
 		return err
@@ -107,6 +190,20 @@ func (client *Client) ListenAndServe(record *ConnRecord, wsc *WebSocketClient, a
 			firstSendData, proxyType, addr, err := client.Reply(conn, enableHttp)
 			if err != nil {
 				log.Error("reply error: ", err)
+				return
+			}
+			if proxyType == ProxyTypeHttp {
+				client.wgClose.Add(1)
+				defer client.wgClose.Done()
+				// the data received is read again, and the requests are served one by one.
+				reader := bufio.NewReaderSize(io.MultiReader(bytes.NewReader(firstSendData), conn), maxHeaderSize)
+				client.httpProxy.serveConn(conn, bufio.NewReadWriter(reader, bufio.NewWriter(conn)), nil)
+				return
+			}
+			wsc, err := picker.Pick()
+			if err != nil {
+				log.Error("no available connection to server: ", err)
+				return
 			}
 			client.wgClose.Add(1)
 			defer client.wgClose.Done()
@@ -115,6 +212,24 @@ func (client *Client) ListenAndServe(record *ConnRecord, wsc *WebSocketClient, a
 			record.Update(ConnStatus{IsNew: true, Address: addr, Type: proxyType})
 			defer record.Update(ConnStatus{IsNew: false, Address: addr, Type: proxyType})
 
+			if proxyType == ProxyTypeSocks5Udp {
+				if err := client.transDatagrams(wsc, conn, addr); err != nil {
+					log.Error("udp association error: ", err)
+				}
+				return
+			}
+			if feature, ok := proxyTypeFeatures[proxyType]; ok && !wsc.HasFeature(feature) {
+				estErr := ProxyEstError{Code: EstErrNotSupported, Message: ProxyTypeStr(proxyType) + " proxy is not supported by server"}
+				_ = writeEstError(conn, proxyType, &estErr)
+				log.Error(estErr.Message)
+				return
+			}
+			if proxyType == ProxyTypeSocks5Resolve || proxyType == ProxyTypeSocks5ResolvePtr {
+				if err := client.resolve(wsc, conn, proxyType, addr); err != nil {
+					log.Error("resolve error: ", err)
+				}
+				return
+			}
 			// on connection established, copy data now.
 			if err := client.transData(wsc, conn, firstSendData, proxyType, addr); err != nil {
 				log.Error("trans error: ", err)
@@ -127,28 +242,111 @@ func (client *Client) transData(wsc *WebSocketClient, conn *net.TCPConn, firstSe
 	type Done struct {
 		tell bool
 		err  error
+		half bool // only one direction is finished (half-close)
 	}
-	done := make(chan Done, 2)
+	done := make(chan Done, 3)
 	// defer close(done)
+	finish := func(d Done) {
+		select {
+		case done <- d:
+		default: // enough signals to finish the proxy
+		}
+	}
+
+	halfClose := wsc.HasFeature(FeatureHalfClose)
+	var drain peerDrain
+	id := ksuid.New()
+	// buffer of data from server, if flow control is enabled.
+	// It is created before the proxy, as the callbacks of proxy read it.
+	receiver := wsc.newFlowReceiver(id)
+
+	// called after all data from server is written to conn.
+	onDrained := func() {
+		if drain.onDrained() || !halfClose {
+			finish(Done{tell: false})
+			return
+		}
+		// no more data from server.
+		if err := conn.CloseWrite(); err != nil {
+			finish(Done{tell: true, err: err})
+			return
+		}
+		finish(Done{half: true})
+	}
+
+	// data of transparent proxy and port forwarding is sent after the proxy is established on server
+	// (see proxy_client_transparent.go).
+	var established chan struct{}
+	if proxyType == ProxyTypeTransparent || proxyType == ProxyTypeForward {
+		established = make(chan struct{})
+	}
 
 	// create a with proxy with callback func
-	proxy := wsc.NewProxy(func(id ksuid.KSUID, data ServerData) {
+	proxy := wsc.newProxyWithId(id, func(id ksuid.KSUID, data ServerData) {
+		if data.Tag == TagEstOk {
+			if established != nil {
+				close(established)
+			}
+			return
+		}
+		if halfClose && data.Tag == TagNoMore {
+			if receiver != nil {
+				_ = receiver.Close() // half-close conn after the buffered data is written.
+			} else {
+				onDrained()
+			}
+			return
+		}
+		if receiver != nil {
+			// data is written to conn in another goroutine
+			if _, err := receiver.Write(data.Data); err != nil {
+				finish(Done{tell: true, err: err}) // reset the stream
+			}
+			return
+		}
 		if _, err := conn.Write(data.Data); err != nil {
-			done <- Done{true, err}
+			finish(Done{tell: true, err: err})
 		}
 	}, func(id ksuid.KSUID, tell bool) {
-		done <- Done{tell, nil}
+		if drain.onClosed() {
+			finish(Done{tell: tell})
+			return
+		}
+		if receiver != nil {
+			// the buffered data will be written to conn before finishing.
+			_ = receiver.Close()
+			return
+		}
+		finish(Done{tell: tell})
 	}, func(id ksuid.KSUID, err error) {
+		var estErr *ProxyEstError
+		if errors.As(err, &estErr) {
+			// the connection can not be established by server, reply the reason to proxy client application.
+			_ = writeEstError(conn, proxyType, estErr)
+			finish(Done{tell: false, err: err})
+			return
+		}
 		if err != nil {
-			done <- Done{true, err}
+			finish(Done{tell: true, err: err})
 		}
 	})
+	if receiver != nil {
+		defer receiver.Close()
+		go func() {
+			// copying finishes without error if the connection is closed by server.
+			if err := receiver.copyTo(conn); err != nil {
+				finish(Done{tell: true, err: err})
+			} else {
+				onDrained()
+			}
+		}()
+	}
 
 	// tell server to establish connection
 	if err := proxy.Establish(wsc, firstSendData, proxyType, addr); err != nil {
 		wsc.RemoveProxy(proxy.Id)
-        err := wsc.TellClose(proxy.Id)
-        if err != nil {
+		err := wsc.TellClose(proxy.Id)
+		if err != nil {
 			log.Error("close error", err)
 		}
 		return err
@@ -156,17 +354,39 @@ func (client *Client) transData(wsc *WebSocketClient, conn *net.TCPConn, firstSe
 
 	// trans incoming data from proxy client application.
 	ctx, cancel := context.WithCancel(context.Background())
-	writer := NewWebSocketWriterWithMutex(&wsc.ConcurrentWebSocket, proxy.Id, ctx)
+	writer := wsc.NewProxyWriter(proxy, ctx)
 	go func() {
+		if established != nil {
+			select {
+			case <-established:
+			case <-ctx.Done():
+				return
+			}
+		}
 		_, err := io.Copy(writer, conn)
 		if err != nil {
 			log.Error("write error: ", err)
 		}
-        done <- Done{true, err}
+		if err != nil || !halfClose {
+			finish(Done{tell: true, err: err})
+			return
+		}
+		// tell server there is no more data, but data from server can still be written to conn.
+		if err := wsc.WriteProxyMessage(ctx, proxy.Id, TagNoMore, nil); err != nil {
+			finish(Done{tell: true, err: err})
+			return
+		}
+		finish(Done{half: true})
 	}()
 	defer writer.CloseWsWriter(cancel) // cancel data writing
 
+	// wait until both directions are finished, or the proxy is closed.
 	d := <-done
+	if d.half {
+		if d = <-done; d.half {
+			d = Done{tell: true} // both directions are finished
+		}
+	}
 	wsc.RemoveProxy(proxy.Id)
 	if d.tell {
 		if err := wsc.TellClose(proxy.Id); err != nil {
@@ -187,7 +407,12 @@ func (client *Client) Close(wait bool) error {
 	}
 	close(client.stop)
 	client.closed = true
-	err := client.tcpl.Close()
+	var err error
+	if client.udpl != nil {
+		err = client.udpl.Close()
+	} else {
+		err = client.tcpl.Close()
+	}
 	if wait {
 		client.wgClose.Wait() // wait the active connection to finish
 	}
@@ -4,8 +4,10 @@ import (
 	"context"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"net"
 	"net/http"
 	"nhooyr.io/websocket"
+	"time"
 )
 
 type WebsocksServerConfig struct {
@@ -13,6 +15,21 @@ type WebsocksServerConfig struct {
 	EnableConnKey    bool   // bale connection key
 	ConnKey          string // connection key
 	EnableStatusPage bool   // enable/disable status page
+	// time to keep the proxy connections of a client after its websocket connection is lost,
+	// waiting for the client to resume them. 0 for disabling session resuming.
+	SessionGrace time.Duration
+	// accept compressing data frames if client asks for it.
+	EnableCompression bool
+	CompressThreshold int // min size of data to be compressed, 0 for DefaultCompressThreshold
+	// time to keep a socks5 udp association without any datagram, 0 for DefaultUdpIdleTimeout.
+	UdpIdleTimeout time.Duration
+	// accept socks5 BIND requests, which let clients listen on tcp ports of server.
+	EnableBind bool
+	// dialer to connect to the targets of socks5 and https(CONNECT) proxy, nil for the dialer of DefaultUpstreamConfig.
+	Dialer *net.Dialer
+	// transport to send the requests of http proxy, nil for the transport of DefaultUpstreamConfig.
+	// See UpstreamConfig to make a transport with the same dial policy as Dialer.
+	HttpTransport *http.Transport
 }
 
 type ServerWS struct {
@@ -22,6 +39,12 @@ type ServerWS struct {
 
 // return a a function handling websocket requests from the peer.
 func NewServeWS(hc *HubCollection, config WebsocksServerConfig) *ServerWS {
+	if config.Dialer == nil {
+		config.Dialer = DefaultUpstreamConfig.Dialer()
+	}
+	if config.HttpTransport == nil {
+		config.HttpTransport = DefaultUpstreamConfig.Transport()
+	}
 	return &ServerWS{config: config, hc: hc}
 }
 
@@ -43,14 +66,20 @@ func (s *ServerWS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel := context.WithCancel(r.Context())
 	defer cancel()
 
-	// negotiate version with client.
-	if err := NegVersionServer(ctx, wc, s.config.EnableStatusPage); err != nil {
+	// negotiate version with client, and find the hub to serve the client.
+	hub, err := NegVersionServer(ctx, wc, s.config, s.hc)
+	if err != nil {
 		return
 	}
-
-	hub := s.hc.NewHub(wc)
-	defer s.hc.RemoveProxy(hub.id)
-	defer hub.Close()
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		hub.setLocalIP(addr.IP)
+	}
+	gen := s.hc.Generation(hub)
+	defer func() {
+		hub.readMu.Unlock()
+		// keep the hub for resuming if the session is resumable.
+		s.hc.OnDisconnected(hub, gen, s.config.SessionGrace)
+	}()
 	// read messages from webSocket
 	wc.SetReadLimit(1 << 23) // 8 MiB
 	for {